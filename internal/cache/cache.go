@@ -0,0 +1,78 @@
+// Package cache persists collector results to disk so that cached metrics
+// survive exporter restarts without running every query again.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+// entry is the on-disk format of cached results.
+type entry struct {
+	// Key identifies the query that produced the results.
+	Key     string
+	Results sql.Results
+}
+
+// Key returns a key identifying the given query content. Results saved with
+// one key are never loaded for a different key, so changing a query file
+// invalidates its cached results.
+func Key(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// filename returns the cache file name for the named query.
+func filename(dir, name string) string {
+	return filepath.Join(dir, name+".gob")
+}
+
+// Save writes the results for the named query to dir. The file is written
+// atomically, so a concurrent Load never reads a partial file.
+func Save(dir, name, key string, r *sql.Results) error {
+	tmp, err := ioutil.TempFile(dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// NOTE: gob is used rather than JSON because query values may be NaN.
+	err = gob.NewEncoder(tmp).Encode(&entry{Key: key, Results: *r})
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename(dir, name))
+}
+
+// Load reads the results for the named query from dir. Load returns an error
+// if the results were saved with a different key or are older than maxAge.
+func Load(dir, name, key string, maxAge time.Duration) (*sql.Results, error) {
+	f, err := os.Open(filename(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	e := &entry{}
+	err = gob.NewDecoder(f).Decode(e)
+	if err != nil {
+		return nil, err
+	}
+	if e.Key != key {
+		return nil, fmt.Errorf("cached results for %q are from a different query", name)
+	}
+	if age := time.Since(e.Results.Updated); age > maxAge {
+		return nil, fmt.Errorf("cached results for %q are too old: %v", name, age)
+	}
+	return &e.Results, nil
+}
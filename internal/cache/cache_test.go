@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	rtx.Must(err, "Failed to create tempdir")
+	defer os.RemoveAll(dir)
+
+	r := &sql.Results{
+		Metrics: []sql.Metric{
+			sql.NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1.1}),
+		},
+		Schema:  &sql.Schema{LabelKeys: []string{"key"}, ValueKeys: []string{""}},
+		Updated: time.Now().Add(-time.Minute).Round(0),
+	}
+	key := Key([]byte("SELECT 'thing' AS key, 1.1 AS value"))
+	if err := Save(dir, "bq_example", key, r); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		key     string
+		maxAge  time.Duration
+		want    *sql.Results
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			query:  "bq_example",
+			key:    key,
+			maxAge: time.Hour,
+			want:   r,
+		},
+		{
+			name:    "error-different-key",
+			query:   "bq_example",
+			key:     Key([]byte("SELECT 1 AS value")),
+			maxAge:  time.Hour,
+			wantErr: true,
+		},
+		{
+			name:    "error-too-old",
+			query:   "bq_example",
+			key:     key,
+			maxAge:  time.Second,
+			wantErr: true,
+		},
+		{
+			name:    "error-missing",
+			query:   "bq_missing",
+			key:     key,
+			maxAge:  time.Hour,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Load(dir, tt.query, tt.key, tt.maxAge)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Load() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSave_NaN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	rtx.Must(err, "Failed to create tempdir")
+	defer os.RemoveAll(dir)
+
+	r := &sql.Results{
+		Metrics: []sql.Metric{sql.NewMetric(nil, nil, map[string]float64{"": math.NaN()})},
+		Updated: time.Now(),
+	}
+	if err := Save(dir, "bq_nan", "key", r); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	got, err := Load(dir, "bq_nan", "key", time.Hour)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !math.IsNaN(got.Metrics[0].Values[""]) {
+		t.Errorf("Load() = %v, want NaN", got.Metrics[0].Values[""])
+	}
+}
+
+func TestSave_Error(t *testing.T) {
+	err := Save(filepath.Join("dir-does-not-exist", "x"), "bq_example", "key", &sql.Results{})
+	if err == nil {
+		t.Errorf("Save() expected error for missing directory")
+	}
+}
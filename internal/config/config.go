@@ -0,0 +1,236 @@
+// Package config defines the optional exporter configuration file. The
+// configuration file declares query files together with per-query settings
+// that cannot be expressed with command line flags.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/schedule"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings read from a configuration file.
+type Config struct {
+	// Labels are constant labels added to every metric from every query.
+	Labels map[string]string `yaml:"labels"`
+	// Queries lists the query files to run.
+	Queries []Query `yaml:"queries"`
+}
+
+// Query holds the settings for a single query file.
+type Query struct {
+	// File is the name of the file containing the query. File is required.
+	File string `yaml:"file"`
+	// Labels are constant labels added to every metric from this query. Query
+	// labels take precedence over global labels with the same name.
+	Labels map[string]string `yaml:"labels"`
+	// MaxStaleness is the maximum age of cached results after the last
+	// successful query. Zero means cached results never expire.
+	MaxStaleness time.Duration `yaml:"max_staleness"`
+	// StalePolicy is either "drop" or "mark". Once results are older than
+	// MaxStaleness, "drop" stops reporting them and "mark" continues to report
+	// them. In both cases, the bqx_query_stale metric is set to 1.
+	StalePolicy string `yaml:"stale_policy"`
+	// Schedule is an optional cron expression, e.g. "15 2 * * *", that
+	// determines when the query runs instead of every refresh interval.
+	Schedule string `yaml:"schedule"`
+	// Timezone is the time zone used to evaluate Schedule, e.g. "UTC". The
+	// default is the local time zone.
+	Timezone string `yaml:"timezone"`
+	// Sources optionally lists the BigQuery tables read by the query, e.g.
+	// "project.dataset.table". When set, scheduled runs are skipped if no
+	// source table was modified since the last successful run.
+	Sources []string `yaml:"sources"`
+	// Critical marks queries that must succeed at least once before the
+	// exporter reports that it is ready on /readyz. If no query is critical,
+	// then every query is required.
+	Critical bool `yaml:"critical"`
+	// Columns optionally declares the columns returned by the query, so that
+	// metrics can be described before the query runs for the first time.
+	Columns *Columns `yaml:"columns"`
+	// Type is the metric type of the query values: "gauge" or "counter". The
+	// default is "gauge".
+	Type string `yaml:"type"`
+	// Unit is the unit of the query values in OpenMetrics, e.g. "seconds" or
+	// "bytes". Metric names get the unit as a suffix if they do not end with it.
+	Unit string `yaml:"unit"`
+	// Driver is the name of a database/sql driver, e.g. "postgres" or "mysql",
+	// used to run the query instead of BigQuery. Driver requires a DSN.
+	Driver string `yaml:"driver"`
+	// DSN is the data source name of the database opened with Driver, e.g.
+	// "postgres://exporter:${PGPASSWORD}@db/ops". Environment variables in the
+	// DSN are expanded.
+	DSN string `yaml:"dsn"`
+	// Project is the GCP project of the query. Source tables without a
+	// project refer to this project, and the query runs in this project
+	// unless BillingProject is set. The default is the -project flag.
+	Project string `yaml:"project"`
+	// BillingProject is the GCP project that runs, and is billed for, the
+	// query jobs, if different from Project.
+	BillingProject string `yaml:"billing_project"`
+	// Location is the location of the query jobs, e.g. "US" or "EU".
+	Location string `yaml:"location"`
+	// CredentialsFile is the name of a service account key file used instead
+	// of the application default credentials.
+	CredentialsFile string `yaml:"credentials_file"`
+	// ImpersonateServiceAccount is the email address of a service account
+	// that runs the query, impersonated with the application default
+	// credentials or the CredentialsFile.
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account"`
+}
+
+// Columns declares the label and value columns returned by a query.
+type Columns struct {
+	// Labels are the names of the label columns.
+	Labels []string `yaml:"labels"`
+	// Values are the names of the value columns. Every name must start with
+	// "value", e.g. "value" or "value_count".
+	Values []string `yaml:"values"`
+}
+
+// Stale policies.
+const (
+	StaleDrop = "drop"
+	StaleMark = "mark"
+)
+
+// Metric types.
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+)
+
+// unitRE matches valid units.
+var unitRE = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Load reads and parses the named configuration file.
+func Load(name string) (*Config, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// Parse parses the given configuration file content.
+func Parse(b []byte) (*Config, error) {
+	c := &Config{}
+	err := yaml.Unmarshal(b, c)
+	if err != nil {
+		return nil, err
+	}
+	for i, q := range c.Queries {
+		if q.File == "" {
+			return nil, fmt.Errorf("query %d: file is required", i)
+		}
+		if err := q.Validate(); err != nil {
+			return nil, fmt.Errorf("query %d: %v", i, err)
+		}
+	}
+	return c, nil
+}
+
+// Validate checks the query settings for errors.
+func (q Query) Validate() error {
+	switch q.StalePolicy {
+	case "", StaleDrop, StaleMark:
+	default:
+		return fmt.Errorf("unknown stale_policy %q", q.StalePolicy)
+	}
+	if q.MaxStaleness < 0 {
+		return fmt.Errorf("max_staleness must not be negative")
+	}
+	if q.Timezone != "" && q.Schedule == "" {
+		return fmt.Errorf("timezone requires a schedule")
+	}
+	if q.Schedule != "" {
+		if _, err := schedule.Cron(q.Schedule, q.Timezone); err != nil {
+			return fmt.Errorf("invalid schedule %q: %v", q.Schedule, err)
+		}
+	}
+	switch q.Type {
+	case "", TypeGauge, TypeCounter:
+	default:
+		return fmt.Errorf("unknown type %q", q.Type)
+	}
+	if q.Unit != "" && !unitRE.MatchString(q.Unit) {
+		return fmt.Errorf("invalid unit %q", q.Unit)
+	}
+	if (q.Driver == "") != (q.DSN == "") {
+		return fmt.Errorf("driver and dsn must be set together")
+	}
+	if q.Driver != "" && len(q.Sources) > 0 {
+		return fmt.Errorf("sources are only supported for BigQuery queries")
+	}
+	if q.Driver != "" && q.Client() != (Client{}) {
+		return fmt.Errorf("project, location, and credentials are only supported for BigQuery queries")
+	}
+	if q.Columns != nil {
+		if len(q.Columns.Values) == 0 {
+			return fmt.Errorf("columns must declare at least one value")
+		}
+		for _, v := range q.Columns.Values {
+			if !strings.HasPrefix(v, "value") {
+				return fmt.Errorf("value column %q must start with \"value\"", v)
+			}
+		}
+	}
+	return nil
+}
+
+// WithDefaults returns a copy of q where every unset setting is taken from
+// defaults. Labels are merged, and query labels take precedence.
+func (q Query) WithDefaults(defaults Query) Query {
+	q.Labels = MergeLabels(defaults.Labels, q.Labels)
+	if q.MaxStaleness == 0 {
+		q.MaxStaleness = defaults.MaxStaleness
+	}
+	if q.StalePolicy == "" {
+		q.StalePolicy = defaults.StalePolicy
+	}
+	return q
+}
+
+// Client holds the settings of the BigQuery client for a query. Queries with
+// the same settings share one client.
+type Client struct {
+	// Project is the project of the client, which runs the query jobs.
+	Project                   string
+	Location                  string
+	CredentialsFile           string
+	ImpersonateServiceAccount string
+}
+
+// Client returns the BigQuery client settings of the query. The client
+// project is the BillingProject, if set, or else the Project. The zero Client
+// means the query uses the default client.
+func (q Query) Client() Client {
+	c := Client{
+		Project:                   q.BillingProject,
+		Location:                  q.Location,
+		CredentialsFile:           q.CredentialsFile,
+		ImpersonateServiceAccount: q.ImpersonateServiceAccount,
+	}
+	if c.Project == "" {
+		c.Project = q.Project
+	}
+	return c
+}
+
+// MergeLabels returns a new map with the given global labels and the query
+// labels. Query labels take precedence.
+func MergeLabels(global, query map[string]string) map[string]string {
+	labels := make(map[string]string, len(global)+len(query))
+	for k, v := range global {
+		labels[k] = v
+	}
+	for k, v := range query {
+		labels[k] = v
+	}
+	return labels
+}
@@ -0,0 +1,270 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *Config
+		wantErr bool
+	}{
+		{
+			name: "success",
+			content: `
+labels:
+  env: prod
+queries:
+  - file: /queries/bq_example.sql
+    labels:
+      team: ops
+  - file: /queries/bq_other.sql
+    max_staleness: 2h
+    stale_policy: mark
+`,
+			want: &Config{
+				Labels: map[string]string{"env": "prod"},
+				Queries: []Query{
+					{File: "/queries/bq_example.sql", Labels: map[string]string{"team": "ops"}},
+					{File: "/queries/bq_other.sql", MaxStaleness: 2 * time.Hour, StalePolicy: StaleMark},
+				},
+			},
+		},
+		{
+			name:    "error-stale-policy",
+			content: "queries:\n  - file: a.sql\n    stale_policy: keep\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-negative-max-staleness",
+			content: "queries:\n  - file: a.sql\n    max_staleness: -1h\n",
+			wantErr: true,
+		},
+		{
+			name: "success-columns",
+			content: `
+queries:
+  - file: a.sql
+    columns:
+      labels: [machine]
+      values: [value, value_count]
+`,
+			want: &Config{
+				Queries: []Query{
+					{File: "a.sql", Columns: &Columns{Labels: []string{"machine"}, Values: []string{"value", "value_count"}}},
+				},
+			},
+		},
+		{
+			name:    "error-columns-without-values",
+			content: "queries:\n  - file: a.sql\n    columns: {labels: [machine]}\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-columns-bad-value",
+			content: "queries:\n  - file: a.sql\n    columns: {values: [count]}\n",
+			wantErr: true,
+		},
+		{
+			name:    "success-schedule",
+			content: "queries:\n  - file: a.sql\n    schedule: 15 2 * * *\n    timezone: UTC\n",
+			want: &Config{
+				Queries: []Query{{File: "a.sql", Schedule: "15 2 * * *", Timezone: "UTC"}},
+			},
+		},
+		{
+			name:    "success-sources",
+			content: "queries:\n  - file: a.sql\n    sources: [ndt.downloads, mlab-oti.ndt.uploads]\n",
+			want: &Config{
+				Queries: []Query{{File: "a.sql", Sources: []string{"ndt.downloads", "mlab-oti.ndt.uploads"}}},
+			},
+		},
+		{
+			name:    "success-critical",
+			content: "queries:\n  - file: a.sql\n    critical: true\n",
+			want: &Config{
+				Queries: []Query{{File: "a.sql", Critical: true}},
+			},
+		},
+		{
+			name:    "success-type-unit",
+			content: "queries:\n  - file: a.sql\n    type: counter\n    unit: bytes\n",
+			want: &Config{
+				Queries: []Query{{File: "a.sql", Type: TypeCounter, Unit: "bytes"}},
+			},
+		},
+		{
+			name:    "error-type",
+			content: "queries:\n  - file: a.sql\n    type: histogram\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-unit",
+			content: "queries:\n  - file: a.sql\n    unit: Seconds\n",
+			wantErr: true,
+		},
+		{
+			name:    "success-dsn",
+			content: "queries:\n  - file: a.sql\n    driver: postgres\n    dsn: postgres://db/ops\n",
+			want: &Config{
+				Queries: []Query{{File: "a.sql", Driver: "postgres", DSN: "postgres://db/ops"}},
+			},
+		},
+		{
+			name:    "error-driver-without-dsn",
+			content: "queries:\n  - file: a.sql\n    driver: postgres\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-dsn-sources",
+			content: "queries:\n  - file: a.sql\n    driver: postgres\n    dsn: postgres://db/ops\n    sources: [ops.jobs]\n",
+			wantErr: true,
+		},
+		{
+			name: "success-client",
+			content: `
+queries:
+  - file: a.sql
+    project: mlab-oti
+    billing_project: mlab-billing
+    location: EU
+    credentials_file: /secrets/key.json
+    impersonate_service_account: exporter@mlab-oti.iam.gserviceaccount.com
+`,
+			want: &Config{
+				Queries: []Query{{
+					File:                      "a.sql",
+					Project:                   "mlab-oti",
+					BillingProject:            "mlab-billing",
+					Location:                  "EU",
+					CredentialsFile:           "/secrets/key.json",
+					ImpersonateServiceAccount: "exporter@mlab-oti.iam.gserviceaccount.com",
+				}},
+			},
+		},
+		{
+			name:    "error-dsn-project",
+			content: "queries:\n  - file: a.sql\n    driver: postgres\n    dsn: postgres://db/ops\n    project: mlab-oti\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-schedule",
+			content: "queries:\n  - file: a.sql\n    schedule: daily\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-timezone-without-schedule",
+			content: "queries:\n  - file: a.sql\n    timezone: UTC\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-missing-file",
+			content: "queries:\n  - labels: {team: ops}\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-yaml",
+			content: "queries: [",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "config_*.yml")
+	rtx.Must(err, "Failed to create temp file")
+	defer os.Remove(tmp.Name())
+	tmp.WriteString("queries:\n  - file: example.sql\n")
+	tmp.Close()
+
+	c, err := Load(tmp.Name())
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(c.Queries) != 1 || c.Queries[0].File != "example.sql" {
+		t.Errorf("Load() = %#v, want one query for example.sql", c)
+	}
+	_, err = Load("file-not-found.yml")
+	if err == nil {
+		t.Errorf("Load() expected error for missing file")
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	got := MergeLabels(
+		map[string]string{"env": "prod", "team": "ops"},
+		map[string]string{"team": "dev", "query": "example"})
+	want := map[string]string{"env": "prod", "team": "dev", "query": "example"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeLabels() = %v, want %v", got, want)
+	}
+}
+
+func TestQuery_WithDefaults(t *testing.T) {
+	defaults := Query{
+		Labels:       map[string]string{"env": "prod"},
+		MaxStaleness: time.Hour,
+		StalePolicy:  StaleDrop,
+	}
+	got := Query{File: "a.sql", StalePolicy: StaleMark}.WithDefaults(defaults)
+	want := Query{
+		File:         "a.sql",
+		Labels:       map[string]string{"env": "prod"},
+		MaxStaleness: time.Hour,
+		StalePolicy:  StaleMark,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WithDefaults() = %#v, want %#v", got, want)
+	}
+}
+
+func TestQuery_Client(t *testing.T) {
+	tests := []struct {
+		name string
+		q    Query
+		want Client
+	}{
+		{
+			name: "default",
+			q:    Query{File: "a.sql", Sources: []string{"ndt.downloads"}},
+			want: Client{},
+		},
+		{
+			name: "project",
+			q:    Query{File: "a.sql", Project: "mlab-oti", Location: "EU"},
+			want: Client{Project: "mlab-oti", Location: "EU"},
+		},
+		{
+			name: "billing-project",
+			q:    Query{File: "a.sql", Project: "mlab-oti", BillingProject: "mlab-billing", CredentialsFile: "key.json"},
+			want: Client{Project: "mlab-billing", CredentialsFile: "key.json"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.q.Client(); got != tt.want {
+				t.Errorf("Client() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
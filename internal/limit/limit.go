@@ -0,0 +1,106 @@
+// Package limit bounds the number of queries that run concurrently, both in
+// total and per GCP project.
+package limit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bqx_query_queue_depth",
+		Help: "The number of queries waiting to run because of concurrency limits",
+	}, []string{"project"})
+	waitDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bqx_query_wait_duration_seconds",
+		Help:    "Time queries waited to run because of concurrency limits",
+		Buckets: []float64{.01, .1, .5, 1, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"project"})
+)
+
+// Limiter bounds the number of concurrent queries. A Limiter behaves like a
+// set of semaphores: one global, and one for each project.
+type Limiter struct {
+	global     chan struct{}
+	perProject int
+
+	mux      sync.Mutex
+	projects map[string]chan struct{}
+}
+
+// New creates a new Limiter that allows at most global concurrent queries in
+// total and perProject concurrent queries for each project. A limit of zero
+// or less means unlimited.
+func New(global, perProject int) *Limiter {
+	l := &Limiter{
+		perProject: perProject,
+		projects:   map[string]chan struct{}{},
+	}
+	if global > 0 {
+		l.global = make(chan struct{}, global)
+	}
+	return l
+}
+
+// project returns the semaphore for the named project, or nil if unlimited.
+func (l *Limiter) project(name string) chan struct{} {
+	if l.perProject <= 0 {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	sem, ok := l.projects[name]
+	if !ok {
+		sem = make(chan struct{}, l.perProject)
+		l.projects[name] = sem
+	}
+	return sem
+}
+
+// Acquire blocks until a query for the given project may run, or until ctx is
+// done. On success, the caller must call the returned release function when
+// the query completes.
+func (l *Limiter) Acquire(ctx context.Context, project string) (func(), error) {
+	start := time.Now()
+	queueDepth.WithLabelValues(project).Inc()
+	defer queueDepth.WithLabelValues(project).Dec()
+
+	// Acquire the project semaphore first, so that queries waiting for their
+	// project do not hold global slots that other projects could use.
+	psem := l.project(project)
+	if err := acquire(ctx, psem); err != nil {
+		return nil, err
+	}
+	if err := acquire(ctx, l.global); err != nil {
+		release(psem)
+		return nil, err
+	}
+	waitDuration.WithLabelValues(project).Observe(time.Since(start).Seconds())
+	return func() {
+		release(l.global)
+		release(psem)
+	}, nil
+}
+
+func acquire(ctx context.Context, sem chan struct{}) error {
+	if sem == nil {
+		return nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
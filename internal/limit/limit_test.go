@@ -0,0 +1,84 @@
+package limit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/prometheusx/promtest"
+)
+
+func TestLimiter_Acquire(t *testing.T) {
+	tests := []struct {
+		name       string
+		global     int
+		perProject int
+		projects   []string
+		want       int64
+	}{
+		{name: "global", global: 2, projects: []string{"a", "b"}, want: 2},
+		{name: "per-project", perProject: 1, projects: []string{"a", "b"}, want: 2},
+		{name: "per-project-single", perProject: 3, projects: []string{"a"}, want: 3},
+		{name: "both", global: 3, perProject: 2, projects: []string{"a", "b"}, want: 3},
+		{name: "unlimited", projects: []string{"a"}, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.global, tt.perProject)
+			var running, max int64
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(project string) {
+					defer wg.Done()
+					release, err := l.Acquire(context.Background(), project)
+					if err != nil {
+						t.Errorf("Acquire() error = %v", err)
+						return
+					}
+					n := atomic.AddInt64(&running, 1)
+					for m := atomic.LoadInt64(&max); n > m; m = atomic.LoadInt64(&max) {
+						atomic.CompareAndSwapInt64(&max, m, n)
+					}
+					time.Sleep(10 * time.Millisecond)
+					atomic.AddInt64(&running, -1)
+					release()
+				}(tt.projects[i%len(tt.projects)])
+			}
+			wg.Wait()
+			if max != tt.want {
+				t.Errorf("Acquire() allowed %d concurrent queries, want %d", max, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiter_AcquireCanceled(t *testing.T) {
+	for _, l := range []*Limiter{New(1, 0), New(0, 1)} {
+		release, err := l.Acquire(context.Background(), "a")
+		if err != nil {
+			t.Fatalf("Acquire() error = %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err = l.Acquire(ctx, "a")
+		cancel()
+		if err == nil {
+			t.Errorf("Acquire() expected error when context is canceled")
+		}
+		release()
+		// After release, the slot is available again.
+		release, err = l.Acquire(context.Background(), "a")
+		if err != nil {
+			t.Fatalf("Acquire() error = %v", err)
+		}
+		release()
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	queueDepth.WithLabelValues("x")
+	waitDuration.WithLabelValues("x")
+	promtest.LintMetrics(t)
+}
@@ -0,0 +1,325 @@
+// Package remotewrite sends samples to a Prometheus remote write endpoint,
+// such as Prometheus, Mimir, or a Thanos receiver. Unlike scraped metrics,
+// remote write samples may have historical timestamps.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Label is a label name and value of a time series.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value of a time series at a given time.
+type Sample struct {
+	Value     float64
+	Timestamp time.Time
+}
+
+// TimeSeries is a set of samples with the same labels, including the metric
+// name as the "__name__" label. Labels must be sorted by name, and samples
+// must be sorted by time.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// Client sends time series to a remote write endpoint.
+type Client struct {
+	// URL is the remote write endpoint.
+	URL string
+	// Headers are added to every request, e.g. for authorization.
+	Headers map[string]string
+	// BatchSize is the maximum number of samples sent in one request.
+	BatchSize int
+	// Retries is the number of times a failed request is retried.
+	Retries int
+	// Backoff is the delay before the first retry. The delay doubles after
+	// every retry.
+	Backoff time.Duration
+	// HTTPClient sends the requests.
+	HTTPClient *http.Client
+}
+
+// New creates a new Client for the given endpoint with default settings.
+func New(url string) *Client {
+	return &Client{
+		URL:        url,
+		BatchSize:  500,
+		Retries:    3,
+		Backoff:    time.Second,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// StatusError is the error for a request that the remote write endpoint
+// rejected with an HTTP error status.
+type StatusError struct {
+	// StatusCode is the HTTP status code of the response, e.g. 400.
+	StatusCode int
+	// Status is the HTTP status of the response, e.g. "400 Bad Request".
+	Status string
+	// Message is the beginning of the response body.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("remote write failed: %s: %s", e.Status, e.Message)
+}
+
+// Retryable reports whether the request may succeed when sent again, i.e.
+// for server errors and rate limited requests. Other requests were rejected
+// permanently, e.g. because they contain out of order samples.
+func (e *StatusError) Retryable() bool {
+	return e.StatusCode/100 == 5 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Write sends the given time series in requests of at most BatchSize
+// samples. The order of the series is preserved. Write stops at the first
+// request that fails after all retries.
+func (c *Client) Write(ctx context.Context, series []TimeSeries) error {
+	for _, batch := range batches(series, c.BatchSize) {
+		err := c.send(ctx, snappy.Encode(nil, Marshal(batch)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batches splits series into batches of at most size samples. Series with
+// more than size samples are split as well. A size of zero or less means one
+// batch.
+func batches(series []TimeSeries, size int) [][]TimeSeries {
+	result := [][]TimeSeries{}
+	batch := []TimeSeries{}
+	n := 0
+	for _, ts := range series {
+		for len(ts.Samples) > 0 {
+			k := len(ts.Samples)
+			if size > 0 && n+k > size {
+				k = size - n
+			}
+			batch = append(batch, TimeSeries{Labels: ts.Labels, Samples: ts.Samples[:k]})
+			ts.Samples = ts.Samples[k:]
+			n += k
+			if size > 0 && n == size {
+				result = append(result, batch)
+				batch, n = []TimeSeries{}, 0
+			}
+		}
+	}
+	if n > 0 {
+		result = append(result, batch)
+	}
+	return result
+}
+
+// send posts the compressed request body, and retries network errors,
+// server errors, and rate limited requests.
+func (c *Client) send(ctx context.Context, body []byte) error {
+	backoff := c.Backoff
+	var err error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+		var retry bool
+		retry, err = c.post(ctx, body)
+		if !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// post sends one request, and reports whether a failed request should be
+// retried.
+func (c *Client) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	se := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Message: string(bytes.TrimSpace(msg))}
+	return se.Retryable(), se
+}
+
+// Field numbers of the remote write protobuf messages.
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+// Marshal encodes the given time series as an uncompressed prometheus.WriteRequest
+// protobuf message.
+func Marshal(series []TimeSeries) []byte {
+	var b []byte
+	for _, ts := range series {
+		var tb []byte
+		for _, l := range ts.Labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, labelName, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.Name)
+			lb = protowire.AppendTag(lb, labelValue, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.Value)
+			tb = protowire.AppendTag(tb, timeSeriesLabels, protowire.BytesType)
+			tb = protowire.AppendBytes(tb, lb)
+		}
+		for _, s := range ts.Samples {
+			var sb []byte
+			sb = protowire.AppendTag(sb, sampleValue, protowire.Fixed64Type)
+			sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+			sb = protowire.AppendTag(sb, sampleTimestamp, protowire.VarintType)
+			sb = protowire.AppendVarint(sb, uint64(s.Timestamp.UnixMilli()))
+			tb = protowire.AppendTag(tb, timeSeriesSamples, protowire.BytesType)
+			tb = protowire.AppendBytes(tb, sb)
+		}
+		b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, tb)
+	}
+	return b
+}
+
+// DecodeRequest decodes the snappy compressed body of a request sent by
+// Write, e.g. in a test receiver. Unknown fields are ignored.
+func DecodeRequest(body []byte) ([]TimeSeries, error) {
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	series := []TimeSeries{}
+	err = consumeMessage(b, func(num protowire.Number, v []byte) error {
+		if num != writeRequestTimeseries {
+			return nil
+		}
+		ts := TimeSeries{}
+		err := consumeMessage(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case timeSeriesLabels:
+				l := Label{}
+				err := consumeMessage(v, func(num protowire.Number, v []byte) error {
+					switch num {
+					case labelName:
+						l.Name = string(v)
+					case labelValue:
+						l.Value = string(v)
+					}
+					return nil
+				})
+				ts.Labels = append(ts.Labels, l)
+				return err
+			case timeSeriesSamples:
+				s, err := decodeSample(v)
+				ts.Samples = append(ts.Samples, s)
+				return err
+			}
+			return nil
+		})
+		series = append(series, ts)
+		return err
+	})
+	return series, err
+}
+
+// consumeMessage calls visit with the value of every length delimited field
+// in the message b. Other fields are skipped.
+func consumeMessage(b []byte, visit func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := visit(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeSample decodes a prometheus.Sample protobuf message.
+func decodeSample(b []byte) (Sample, error) {
+	s := Sample{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return s, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == sampleValue && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return s, protowire.ParseError(n)
+			}
+			s.Value = math.Float64frombits(v)
+			b = b[n:]
+		case num == sampleTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return s, protowire.ParseError(n)
+			}
+			s.Timestamp = time.UnixMilli(int64(v)).UTC()
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return s, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,190 @@
+package remotewrite
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a mock remote write endpoint that records every request and
+// responds with the given status codes in order, then 200.
+type receiver struct {
+	mux      sync.Mutex
+	codes    []int
+	requests [][]TimeSeries
+	headers  []http.Header
+}
+
+func (r *receiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	b, _ := ioutil.ReadAll(req.Body)
+	series, err := DecodeRequest(b)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.requests = append(r.requests, series)
+	r.headers = append(r.headers, req.Header)
+	if len(r.codes) > 0 {
+		code := r.codes[0]
+		r.codes = r.codes[1:]
+		rw.WriteHeader(code)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func newSeries(name string, values ...float64) TimeSeries {
+	ts := TimeSeries{Labels: []Label{{Name: "__name__", Value: name}, {Name: "site", Value: "lga01"}}}
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, v := range values {
+		ts.Samples = append(ts.Samples, Sample{Value: v, Timestamp: start.AddDate(0, 0, i)})
+	}
+	return ts
+}
+
+func TestClient_Write(t *testing.T) {
+	series := []TimeSeries{newSeries("a", 1, 2, 3), newSeries("b", 4)}
+	tests := []struct {
+		name         string
+		batchSize    int
+		codes        []int
+		wantRequests int
+		wantErr      bool
+	}{
+		{
+			name:         "one-batch",
+			batchSize:    500,
+			wantRequests: 1,
+		},
+		{
+			name:         "split-batches",
+			batchSize:    2,
+			wantRequests: 2,
+		},
+		{
+			name:         "retry-server-error",
+			batchSize:    500,
+			codes:        []int{http.StatusInternalServerError, http.StatusTooManyRequests},
+			wantRequests: 3,
+		},
+		{
+			name:         "error-bad-request",
+			batchSize:    500,
+			codes:        []int{http.StatusBadRequest},
+			wantRequests: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "error-retries-exhausted",
+			batchSize:    500,
+			codes:        []int{500, 500, 500, 500},
+			wantRequests: 4,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &receiver{codes: tt.codes}
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+			c := New(srv.URL)
+			c.BatchSize = tt.batchSize
+			c.Backoff = time.Millisecond
+			c.Headers = map[string]string{"X-Scope-OrgID": "tenant"}
+
+			err := c.Write(context.Background(), series)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(r.requests) != tt.wantRequests {
+				t.Fatalf("Write() sent %d requests, want %d", len(r.requests), tt.wantRequests)
+			}
+			h := r.headers[0]
+			if h.Get("Content-Encoding") != "snappy" || h.Get("X-Scope-OrgID") != "tenant" {
+				t.Errorf("Write() headers = %v", h)
+			}
+			if tt.wantErr {
+				return
+			}
+			// The samples received in the last successful requests match.
+			got := []TimeSeries{}
+			for _, req := range r.requests[len(r.requests)-len(batches(series, tt.batchSize)):] {
+				got = append(got, req...)
+			}
+			if !reflect.DeepEqual(merge(got), series) {
+				t.Errorf("Write() sent %#v, want %#v", got, series)
+			}
+		})
+	}
+}
+
+func TestClient_Write_statusError(t *testing.T) {
+	for _, code := range []int{http.StatusBadRequest, http.StatusInternalServerError} {
+		r := &receiver{codes: []int{code}}
+		srv := httptest.NewServer(r)
+		c := New(srv.URL)
+		c.Retries = 0
+		err := c.Write(context.Background(), []TimeSeries{newSeries("a", 1)})
+		srv.Close()
+		se, ok := err.(*StatusError)
+		if !ok || se.StatusCode != code {
+			t.Fatalf("Write() error = %#v, want StatusError with code %d", err, code)
+		}
+		if want := code != http.StatusBadRequest; se.Retryable() != want {
+			t.Errorf("StatusError.Retryable() = %t for code %d, want %t", se.Retryable(), code, want)
+		}
+	}
+}
+
+// merge joins consecutive series with the same name.
+func merge(series []TimeSeries) []TimeSeries {
+	result := []TimeSeries{}
+	for _, ts := range series {
+		n := len(result)
+		if n > 0 && reflect.DeepEqual(result[n-1].Labels, ts.Labels) {
+			result[n-1].Samples = append(result[n-1].Samples, ts.Samples...)
+			continue
+		}
+		result = append(result, ts)
+	}
+	return result
+}
+
+func Test_batches(t *testing.T) {
+	series := []TimeSeries{newSeries("a", 1, 2, 3), newSeries("b", 4)}
+	tests := []struct {
+		size int
+		want []int
+	}{
+		{size: 0, want: []int{4}},
+		{size: 1, want: []int{1, 1, 1, 1}},
+		{size: 3, want: []int{3, 1}},
+		{size: 4, want: []int{4}},
+	}
+	for _, tt := range tests {
+		got := []int{}
+		for _, b := range batches(series, tt.size) {
+			n := 0
+			for _, ts := range b {
+				n += len(ts.Samples)
+			}
+			got = append(got, n)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("batches(%d) sizes = %v, want %v", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeRequest_error(t *testing.T) {
+	if _, err := DecodeRequest([]byte("not snappy")); err == nil {
+		t.Errorf("DecodeRequest() expected error")
+	}
+}
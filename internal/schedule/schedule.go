@@ -0,0 +1,40 @@
+// Package schedule determines when queries run, either at fixed intervals or
+// according to cron expressions.
+package schedule
+
+import (
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule reports the next time a query should run.
+type Schedule interface {
+	// Next returns the next run time strictly after t.
+	Next(t time.Time) time.Time
+}
+
+type every time.Duration
+
+// Every returns a Schedule that runs at every multiple of d, i.e. every
+// interval aligned to the wall clock.
+func Every(d time.Duration) Schedule {
+	return every(d)
+}
+
+// Next returns the nearest time after t that is a multiple of the interval.
+func (e every) Next(t time.Time) time.Time {
+	d := time.Duration(e)
+	return t.Truncate(d).Add(d)
+}
+
+// Cron parses a standard five field cron expression, e.g. "15 2 * * *" for
+// every day at 02:15, or "*/10 9-17 * * MON-FRI" for every ten minutes during
+// business hours. The expression is evaluated in the named time zone, e.g.
+// "UTC" or "America/New_York". If tz is empty, the local time zone is used.
+func Cron(expr, tz string) (Schedule, error) {
+	if tz != "" {
+		expr = "CRON_TZ=" + tz + " " + expr
+	}
+	return cron.ParseStandard(expr)
+}
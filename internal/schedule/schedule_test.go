@@ -0,0 +1,79 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvery(t *testing.T) {
+	s := Every(5 * time.Minute)
+	now := time.Date(2023, 4, 1, 10, 7, 30, 0, time.UTC)
+	want := time.Date(2023, 4, 1, 10, 10, 0, 0, time.UTC)
+	if got := s.Next(now); !got.Equal(want) {
+		t.Errorf("Every().Next() = %v, want %v", got, want)
+	}
+	// A time at a boundary returns the following boundary.
+	want2 := time.Date(2023, 4, 1, 10, 15, 0, 0, time.UTC)
+	if got := s.Next(want); !got.Equal(want2) {
+		t.Errorf("Every().Next() = %v, want %v", got, want2)
+	}
+}
+
+func TestCron(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+	now := time.Date(2023, 4, 1, 10, 7, 30, 0, time.UTC) // A Saturday.
+	tests := []struct {
+		name    string
+		expr    string
+		tz      string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name: "daily-utc",
+			expr: "15 2 * * *",
+			tz:   "UTC",
+			want: time.Date(2023, 4, 2, 2, 15, 0, 0, time.UTC),
+		},
+		{
+			name: "daily-new-york",
+			expr: "15 2 * * *",
+			tz:   "America/New_York",
+			want: time.Date(2023, 4, 2, 2, 15, 0, 0, ny),
+		},
+		{
+			name: "business-hours",
+			expr: "*/10 9-17 * * MON-FRI",
+			tz:   "UTC",
+			want: time.Date(2023, 4, 3, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "error-bad-expression",
+			expr:    "every day",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-timezone",
+			expr:    "15 2 * * *",
+			tz:      "Mars/Olympus_Mons",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Cron(tt.expr, tt.tz)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Cron() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := s.Next(now); !got.Equal(tt.want) {
+				t.Errorf("Cron().Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
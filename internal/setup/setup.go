@@ -4,11 +4,17 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/m-lab/go/logx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/schedule"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/spf13/afero"
+	"google.golang.org/protobuf/proto"
 )
 
 var fs = afero.NewOsFs()
@@ -17,8 +23,108 @@ var fs = afero.NewOsFs()
 // registered with the prometheus collector registry.
 type File struct {
 	Name string
+	// Config holds the query settings for this file, including defaults.
+	Config config.Query
+	// Schedule determines when the file is updated.
+	Schedule schedule.Schedule
+
 	stat os.FileInfo
-	c    *sql.Collector
+
+	// mux locks access to c, next, and status.
+	mux sync.Mutex
+	c   *sql.Collector
+	// next is the next scheduled update time. Zero means update immediately.
+	next   time.Time
+	status Status
+}
+
+// Status reports the outcome of the runs of a query file.
+type Status struct {
+	// Runs counts the completed runs, successful or not.
+	Runs int
+	// LastRun is the start time of the most recent run.
+	LastRun time.Time
+	// LastDuration is the duration of the most recent run.
+	LastDuration time.Duration
+	// LastSuccess is the start time of the most recent successful run.
+	LastSuccess time.Time
+	// LastError is the error from the most recent run, if it failed.
+	LastError error
+	// Skips counts the runs skipped because the results were still current.
+	Skips int
+	// Restored is the update time of results restored without running the
+	// query, e.g. from a cache, if any.
+	Restored time.Time
+}
+
+// Due reports whether the file is scheduled to update at the given time.
+func (f *File) Due(now time.Time) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return !now.Before(f.next)
+}
+
+// ScheduleNext sets the next update time to the first time in the file
+// Schedule after now, and returns it. Files without a Schedule are always due.
+func (f *File) ScheduleNext(now time.Time) time.Time {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.Schedule != nil {
+		f.next = f.Schedule.Next(now)
+	}
+	return f.next
+}
+
+// Next returns the next scheduled update time.
+func (f *File) Next() time.Time {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.next
+}
+
+// RecordRun records the outcome of a run that started at the given time.
+func (f *File) RecordRun(start time.Time, err error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.status.Runs++
+	f.status.LastRun = start
+	f.status.LastDuration = time.Since(start)
+	f.status.LastError = err
+	if err == nil {
+		f.status.LastSuccess = start
+	}
+}
+
+// RecordSkip records a run that was skipped at the given time because the
+// results of the registered collector are still current, e.g. because the
+// source tables are unchanged. The results are marked as current as of start.
+func (f *File) RecordSkip(start time.Time) {
+	if c := f.collector(); c != nil {
+		c.Touch(start)
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.status.Skips++
+	f.status.LastRun = start
+	f.status.LastDuration = time.Since(start)
+	f.status.LastError = nil
+	f.status.LastSuccess = start
+}
+
+// RecordRestore records that results updated at the given time were restored
+// into the registered collector without running the query. Restores do not
+// count as runs.
+func (f *File) RecordRestore(updated time.Time) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.status.Restored = updated
+}
+
+// Status returns the current status of the file.
+func (f *File) Status() Status {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.status
 }
 
 // IsModified reports true if the file has been modified since the last call.
@@ -46,18 +152,24 @@ func (f *File) IsModified() (bool, error) {
 	return modified, nil
 }
 
+// MarkModified makes the next call to IsModified report the file as modified,
+// so that a failed registration is retried.
+func (f *File) MarkModified() {
+	f.stat = nil
+}
+
 // Register the given collector. If a collector was previously registered with
 // this file, then it is unregistered first. If either registration or
 // unregister fails, then the error is returned.
 func (f *File) Register(c *sql.Collector) error {
-	if f.c != nil {
-		ok := prometheus.Unregister(f.c)
+	if prev := f.collector(); prev != nil {
+		ok := prometheus.Unregister(prev)
 		logx.Debug.Println("Unregister:", ok)
 		if !ok {
 			// This is a fatal error. If the
 			return fmt.Errorf("failed to unregister %q", f.Name)
 		}
-		f.c = nil
+		f.setCollector(nil)
 	}
 	// Register runs c.Update().
 	err := prometheus.Register(c)
@@ -67,14 +179,139 @@ func (f *File) Register(c *sql.Collector) error {
 	}
 	logx.Debug.Println("Register:", f.Name, c.RegisterErr)
 	// Save the registered collector.
-	f.c = c
+	f.setCollector(c)
 	return c.RegisterErr
 }
 
-// Update runs the collector query again.
+// collector returns the registered collector, if any.
+func (f *File) collector() *sql.Collector {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.c
+}
+
+// setCollector saves the registered collector.
+func (f *File) setCollector(c *sql.Collector) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.c = c
+}
+
+// Update runs the collector query again. Update returns an error if no
+// collector is registered.
 func (f *File) Update() error {
-	if f.c != nil {
-		return f.c.Update()
+	if c := f.collector(); c != nil {
+		return c.Update()
+	}
+	return fmt.Errorf("%s: no registered collector", f.Name)
+}
+
+// Results returns the cached results of the registered collector, or nil if
+// there are none.
+func (f *File) Results() *sql.Results {
+	if c := f.collector(); c != nil {
+		return c.Results()
 	}
 	return nil
 }
+
+// Query returns the query of the registered collector, with template values
+// replaced, or the empty string if the file is not registered.
+func (f *File) Query() string {
+	if c := f.collector(); c != nil {
+		return c.Query()
+	}
+	return ""
+}
+
+// Units maps the name of every metric reported by the registered collector to
+// its unit. Units is empty if the metrics have no unit.
+func (f *File) Units() map[string]string {
+	if c := f.collector(); c != nil {
+		return c.Units()
+	}
+	return map[string]string{}
+}
+
+// Gather returns the metrics currently reported by the registered collector.
+func (f *File) Gather() ([]*dto.MetricFamily, error) {
+	return gather(f)
+}
+
+// WithUnits returns a prometheus.Gatherer for the metrics from g, where the
+// metrics reported by the collectors of the given files have their units set.
+// The units are only reported by the OpenMetrics format.
+func WithUnits(g prometheus.Gatherer, files []File) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		units := map[string]string{}
+		for i := range files {
+			for name, unit := range files[i].Units() {
+				units[name] = unit
+			}
+		}
+		setUnits(mfs, units)
+		return mfs, err
+	})
+}
+
+// setUnits sets the unit of every metric family found in units.
+func setUnits(mfs []*dto.MetricFamily, units map[string]string) {
+	for _, mf := range mfs {
+		if unit, ok := units[mf.GetName()]; ok {
+			mf.Unit = proto.String(unit)
+		}
+	}
+}
+
+// NewGatherer returns a prometheus.Gatherer for the metrics currently reported
+// by the registered collectors of the given files. Unlike the default
+// gatherer, the result does not include any other metrics of the process.
+func NewGatherer(files []File) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		fs := make([]*File, len(files))
+		for i := range files {
+			fs[i] = &files[i]
+		}
+		return gather(fs...)
+	})
+}
+
+// gather returns the metrics currently reported by the registered collectors
+// of the given files, and their staleness.
+func gather(files ...*File) ([]*dto.MetricFamily, error) {
+	reg := prometheus.NewRegistry()
+	units := map[string]string{}
+	cols := []*sql.Collector{}
+	for _, f := range files {
+		c := f.collector()
+		if c == nil {
+			continue
+		}
+		cols = append(cols, c)
+		// Register the collector without Describe, which would run the query
+		// if the collector had not been described before.
+		err := reg.Register(collectOnly{c})
+		if err != nil {
+			return nil, err
+		}
+		for name, unit := range c.Units() {
+			units[name] = unit
+		}
+	}
+	if err := reg.Register(sql.NewStaleness(cols...)); err != nil {
+		return nil, err
+	}
+	mfs, err := reg.Gather()
+	setUnits(mfs, units)
+	return mfs, err
+}
+
+// collectOnly is an unchecked collector that reports the metrics of the
+// embedded collector.
+type collectOnly struct {
+	prometheus.Collector
+}
+
+// Describe sends no descriptions, so that collectOnly is unchecked.
+func (collectOnly) Describe(chan<- *prometheus.Desc) {}
@@ -2,10 +2,12 @@ package setup
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/schedule"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/afero"
@@ -67,6 +69,21 @@ func TestFile_IsModified(t *testing.T) {
 	}
 }
 
+func TestFile_MarkModified(t *testing.T) {
+	fs = afero.NewMemMapFs()
+	fs.Create("localfile")
+
+	f := &File{Name: "localfile"}
+	f.IsModified()
+	if got, _ := f.IsModified(); got {
+		t.Errorf("File.IsModified() = true, want false")
+	}
+	f.MarkModified()
+	if got, _ := f.IsModified(); !got {
+		t.Errorf("File.IsModified() after MarkModified() = false, want true")
+	}
+}
+
 type fakeRunner struct{}
 
 func (f *fakeRunner) Query(query string) ([]sql.Metric, error) {
@@ -81,11 +98,18 @@ func TestFile_Update(t *testing.T) {
 	}{
 		{
 			name: "success",
-			c:    nil,
+			c: sql.NewCollector(&fakeRegister{
+				metric: sql.NewMetric([]string{}, []string{}, map[string]float64{"": 1.23}),
+			}, prometheus.GaugeValue, "foo", "", nil),
+		},
+		{
+			name:    "error-not-registered",
+			c:       nil,
+			wantErr: true,
 		},
 		{
 			name:    "error-from-update",
-			c:       sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, "foo", ""),
+			c:       sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, "foo", "", nil),
 			wantErr: true,
 		},
 	}
@@ -114,7 +138,7 @@ func TestFile_Register(t *testing.T) {
 	fr := &fakeRegister{
 		metric: sql.NewMetric([]string{}, []string{}, map[string]float64{"": 1.23}),
 	}
-	x := sql.NewCollector(fr, prometheus.GaugeValue, "foo", "")
+	x := sql.NewCollector(fr, prometheus.GaugeValue, "foo", "", nil)
 	tests := []struct {
 		name          string
 		fileCollector *sql.Collector
@@ -141,7 +165,7 @@ func TestFile_Register(t *testing.T) {
 		{
 			// Try to unregister a collector that was never registered.
 			name:          "unregister-returns-error",
-			fileCollector: sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, "foo", ""),
+			fileCollector: sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, "foo", "", nil),
 			wantErr:       true,
 		},
 	}
@@ -157,3 +181,120 @@ func TestFile_Register(t *testing.T) {
 		})
 	}
 }
+
+func TestFile_Results(t *testing.T) {
+	f := &File{Name: "example"}
+	if f.Results() != nil {
+		t.Errorf("File.Results() = %v, want nil", f.Results())
+	}
+	fr := &fakeRegister{
+		metric: sql.NewMetric([]string{}, []string{}, map[string]float64{"": 1.23}),
+	}
+	f.c = sql.NewCollector(fr, prometheus.GaugeValue, "foo", "", nil)
+	if err := f.c.Update(); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if r := f.Results(); r == nil || len(r.Metrics) != 1 {
+		t.Errorf("File.Results() = %v, want one metric", r)
+	}
+}
+
+func TestFile_RecordRun(t *testing.T) {
+	f := &File{Name: "example"}
+	start := time.Now()
+	f.RecordRun(start, nil)
+	f.RecordRun(start.Add(time.Second), fmt.Errorf("fake error"))
+	s := f.Status()
+	if s.Runs != 2 || !s.LastRun.Equal(start.Add(time.Second)) || !s.LastSuccess.Equal(start) || s.LastError == nil {
+		t.Errorf("File.Status() = %#v, want 2 runs with last error", s)
+	}
+}
+
+func TestFile_RecordSkip(t *testing.T) {
+	f := &File{Name: "example"}
+	f.RecordRun(time.Now(), fmt.Errorf("fake error"))
+	start := time.Now()
+	f.RecordSkip(start)
+	s := f.Status()
+	if s.Runs != 1 || s.Skips != 1 || !s.LastRun.Equal(start) || !s.LastSuccess.Equal(start) || s.LastError != nil {
+		t.Errorf("File.Status() = %#v, want 1 run and 1 skip without error", s)
+	}
+}
+
+func TestFile_RecordRestore(t *testing.T) {
+	f := &File{Name: "example"}
+	updated := time.Now().Add(-time.Minute)
+	f.RecordRestore(updated)
+	s := f.Status()
+	if s.Runs != 0 || !s.LastSuccess.IsZero() || !s.Restored.Equal(updated) {
+		t.Errorf("File.Status() = %#v, want restored results without runs", s)
+	}
+}
+
+func TestFile_ScheduleNext(t *testing.T) {
+	now := time.Date(2023, 4, 1, 10, 7, 30, 0, time.UTC)
+	f := &File{Name: "example"}
+	if !f.Due(now) || !f.ScheduleNext(now).IsZero() {
+		t.Errorf("File without schedule should always be due")
+	}
+	f.Schedule = schedule.Every(5 * time.Minute)
+	next := f.ScheduleNext(now)
+	if want := time.Date(2023, 4, 1, 10, 10, 0, 0, time.UTC); !next.Equal(want) || !f.Next().Equal(want) {
+		t.Errorf("File.ScheduleNext() = %v, want %v", next, want)
+	}
+	if f.Due(now) {
+		t.Errorf("File.Due(%v) = true, want false", now)
+	}
+	if !f.Due(next) {
+		t.Errorf("File.Due(%v) = false, want true", next)
+	}
+}
+
+func TestFile_QueryGather(t *testing.T) {
+	f := &File{Name: "example"}
+	if f.Query() != "" {
+		t.Errorf("File.Query() = %q, want empty string", f.Query())
+	}
+	if mfs, err := f.Gather(); len(mfs) != 0 || err != nil {
+		t.Errorf("File.Gather() = %v, %v, want no metrics", mfs, err)
+	}
+	fr := &fakeRegister{
+		metric: sql.NewMetric([]string{}, []string{}, map[string]float64{"": 1.23}),
+	}
+	c := sql.NewCollector(fr, prometheus.GaugeValue, "gather", "SELECT 1.23 AS value", nil)
+	rtx.Must(f.Register(c), "Failed to register collector")
+	defer prometheus.Unregister(c)
+	if f.Query() != "SELECT 1.23 AS value" {
+		t.Errorf("File.Query() = %q, want the collector query", f.Query())
+	}
+	mfs, err := f.Gather()
+	if err != nil || len(mfs) != 1 || mfs[0].GetName() != "gather" {
+		t.Errorf("File.Gather() = %v, %v, want one metric family", mfs, err)
+	}
+}
+
+func TestNewGatherer(t *testing.T) {
+	files := []File{{Name: "a.sql"}, {Name: "b.sql"}, {Name: "c.sql"}}
+	for i, name := range []string{"gatherer_a", "gatherer_b"} {
+		fr := &fakeRegister{
+			metric: sql.NewMetric([]string{}, []string{}, map[string]float64{"": 1.23}),
+		}
+		c := sql.NewCollector(fr, prometheus.GaugeValue, name, "", nil)
+		c.SetMaxStaleness(time.Hour, false)
+		rtx.Must(files[i].Register(c), "Failed to register collector")
+		defer prometheus.Unregister(c)
+	}
+	mfs, err := NewGatherer(files).Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	// The stale metrics of both files are merged into one family.
+	got := []string{}
+	for _, mf := range mfs {
+		got = append(got, fmt.Sprintf("%s:%d", mf.GetName(), len(mf.GetMetric())))
+	}
+	want := []string{"bqx_query_stale:2", "gatherer_a:1", "gatherer_b:1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Gather() = %v, want %v", got, want)
+	}
+}
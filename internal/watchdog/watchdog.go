@@ -0,0 +1,40 @@
+// Package watchdog detects a loop that stops making progress, e.g. because a
+// query never returns.
+package watchdog
+
+import (
+	"sync"
+	"time"
+)
+
+// Watchdog tracks the deadline for the next progress report of a loop.
+type Watchdog struct {
+	mux      sync.Mutex
+	deadline time.Time
+}
+
+// New creates a new Watchdog. A Watchdog is healthy until the first call to
+// Kick, so that startup is not limited by the watchdog.
+func New() *Watchdog {
+	return &Watchdog{}
+}
+
+// Kick reports progress and sets the deadline for the next call to Kick to d
+// from now. A d of zero or less disables the deadline.
+func (w *Watchdog) Kick(d time.Duration) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if d <= 0 {
+		w.deadline = time.Time{}
+		return
+	}
+	w.deadline = time.Now().Add(d)
+}
+
+// Healthy reports whether the deadline has not passed at the given time, and
+// returns the deadline. The deadline is zero when it is disabled.
+func (w *Watchdog) Healthy(now time.Time) (bool, time.Time) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.deadline.IsZero() || !now.After(w.deadline), w.deadline
+}
@@ -0,0 +1,25 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	w := New()
+	if ok, _ := w.Healthy(time.Now()); !ok {
+		t.Errorf("Healthy() = false before the first Kick, want true")
+	}
+	w.Kick(time.Minute)
+	ok, deadline := w.Healthy(time.Now())
+	if !ok {
+		t.Errorf("Healthy() = false before the deadline, want true")
+	}
+	if ok, _ := w.Healthy(deadline.Add(time.Second)); ok {
+		t.Errorf("Healthy() = true after the deadline, want false")
+	}
+	w.Kick(0)
+	if ok, deadline := w.Healthy(time.Now().Add(time.Hour)); !ok || !deadline.IsZero() {
+		t.Errorf("Healthy() = %t, %v after disabling the deadline, want true", ok, deadline)
+	}
+}
@@ -6,34 +6,84 @@
 package main
 
 import (
+	dbsql "database/sql"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/logx"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/cache"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/limit"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/remotewrite"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/schedule"
 	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/watchdog"
 	"github.com/m-lab/prometheus-bigquery-exporter/query"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
 
 	"cloud.google.com/go/bigquery"
 	"golang.org/x/net/context"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+
+	// Drivers for queries with a DSN.
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
-	gaugeSources = flagx.StringArray{}
-	project      = flag.String("project", "", "GCP project name.")
-	refresh      = flag.Duration("refresh", 5*time.Minute, "Interval between updating metrics.")
-	keepAlive    = flag.Bool("keepAlive", false, "Keep the process alive even if query fails to execute.")
+	gaugeSources   = flagx.StringArray{}
+	counterSources = flagx.StringArray{}
+	fixtures       = flagx.StringArray{}
+	constLabels    = flagx.KeyValue{}
+	pushGrouping   = flagx.KeyValue{}
+	otlpHeaders    = flagx.KeyValue{}
+	remoteHeaders  = flagx.KeyValue{}
+	project        = flag.String("project", "", "GCP project name.")
+	bqEndpoint     = flag.String("bigquery-endpoint", "", "URL of the BigQuery API, e.g. 'http://localhost:9050' for a local emulator. Uses the production API when empty.")
+	noAuth         = flag.Bool("no-auth", false, "Connect to BigQuery without credentials, e.g. for a local emulator.")
+	refresh        = flag.Duration("refresh", 5*time.Minute, "Interval between updating metrics.")
+	keepAlive      = flag.Bool("keepAlive", false, "Keep the process alive even if query fails to execute.")
+	namespace      = flag.String("namespace", "", "Prefix added to every metric name derived from a query file, e.g. 'bqx_'.")
+	configFile     = flag.String("config", "", "Name of a YAML file with additional queries and per-query settings.")
+	maxStaleness   = flag.Duration("max-staleness", 0, "Default maximum age of cached results after the last successful query. Zero disables expiration.")
+	stalePolicy    = flag.String("stale-policy", config.StaleDrop, "Default handling of expired results: 'drop' or 'mark'.")
+	cacheDir       = flag.String("cache-dir", "", "Directory to save query results after every successful query and restore them at startup. Disabled when empty.")
+	cacheMaxAge    = flag.Duration("cache-max-age", time.Hour, "Maximum age of saved results restored at startup.")
+	maxQueries     = flag.Int("max-concurrent-queries", 0, "Maximum number of queries to run concurrently. Zero means unlimited.")
+	maxPerProject  = flag.Int("max-concurrent-queries-per-project", 0, "Maximum number of queries to run concurrently in each project. Zero means unlimited.")
+	stagger        = flag.Duration("stagger", 0, "Spread query start times over this window after each refresh, using a fixed offset per query name.")
+	jitter         = flag.Duration("jitter", 0, "Delay query start times after each refresh by a random duration up to this value.")
+	asyncRegister  = flag.Bool("async-register", false, "Register collectors before running their queries, so that registration does not wait for query results.")
+	watchdogTime   = flag.Duration("watchdog-timeout", time.Hour, "Maximum time for updating all due queries before /healthz reports the exporter as unhealthy. Zero disables the watchdog.")
+	once           = flag.Bool("once", false, "Run every query once, print the metrics to stdout, export them to any configured textfile or Pushgateway, and exit. Exits with a non-zero status if any query fails.")
+	onceFormat     = flag.String("once-format", formatText, "Output format of -once: 'text' for the Prometheus exposition format, or 'json'.")
+	textfileDir    = flag.String("textfile-dir", "", "Directory to write the query metrics to after every refresh, for the node_exporter textfile collector. Disabled when empty.")
+	pushURL        = flag.String("push-url", "", "URL of a Pushgateway to push the query metrics to after every refresh. Disabled when empty.")
+	pushJob        = flag.String("push-job", "bigquery_exporter", "Job name used for pushing to the Pushgateway.")
+	remoteURL      = flag.String("remote-write-url", "", "URL of a Prometheus remote write endpoint to send new query results to after every refresh. Disabled when empty.")
+	remoteBatch    = flag.Int("remote-write-batch-size", 500, "Maximum number of samples in one remote write request.")
+	remoteRetries  = flag.Int("remote-write-retries", 3, "Number of times a failed remote write request is retried.")
+	otlpEndpoint   = flag.String("otlp-endpoint", "", "Host and port of an OpenTelemetry collector to export the query metrics to over OTLP after every refresh, e.g. 'otel-collector:4318'. Disabled when empty.")
+	otlpProtocol   = flag.String("otlp-protocol", otlpHTTP, "OTLP protocol used with -otlp-endpoint: 'http' or 'grpc'.")
+	otlpInsecure   = flag.Bool("otlp-insecure", false, "Export to the -otlp-endpoint without TLS.")
+	adminToken     = flag.String("admin-token", "", "Bearer token required by the admin endpoints /-/refresh and /-/reload. The endpoints are disabled when empty.")
 
 	successFilesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "bqx_success_files_executed_total",
@@ -44,6 +94,10 @@ var (
 		Name: "bqx_failed_files_executed_total",
 		Help: "The total number of failed executed files",
 	}, []string{"filename"})
+	skippedFilesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bqx_skipped_files_total",
+		Help: "The total number of file updates skipped because source tables were unchanged",
+	}, []string{"filename"})
 	updateDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "bqx_query_runtime_duration_seconds",
 		Help:    "Duration taken for updating files",
@@ -52,26 +106,130 @@ var (
 )
 
 func init() {
-	// TODO: support counter queries.
-	// flag.Var(&counterSources, "counter-query", "Name of file containing a counter query.")
+	flag.Var(&counterSources, "counter-query", "Name of file containing a counter query.")
 	flag.Var(&gaugeSources, "gauge-query", "Name of file containing a gauge query.")
+	flag.Var(&fixtures, "fixture", "CSV or JSON file loaded as a table of an in-memory SQLite database. When set, queries without a driver run against this database instead of BigQuery, so no GCP credentials are needed. Repeatable.")
+	flag.Var(&constLabels, "const-label", "Constant label added to every query metric, e.g. 'env=prod'. Repeatable.")
+	flag.Var(&remoteHeaders, "remote-write-header", "HTTP header added to remote write requests, e.g. 'X-Scope-OrgID=tenant'. Repeatable.")
+	flag.Var(&otlpHeaders, "otlp-header", "Header added to OTLP export requests, e.g. 'Authorization=Bearer token'. Repeatable.")
+	flag.Var(&pushGrouping, "push-grouping", "Grouping label used for pushing to the Pushgateway, e.g. 'instance=host1'. Repeatable.")
 
 	// Port registered at https://github.com/prometheus/prometheus/wiki/Default-port-allocations
 	*prometheusx.ListenAddress = ":9348"
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
-// sleepUntilNext finds the nearest future time that is a multiple of the given
-// duration and sleeps until that time.
-func sleepUntilNext(d time.Duration) {
-	next := time.Now().Truncate(d).Add(d)
-	time.Sleep(time.Until(next))
+// nextWakeup returns the earliest scheduled update time of the given files.
+// To detect modified files, nextWakeup is never later than the next multiple
+// of the refresh interval.
+func nextWakeup(files []setup.File, refresh time.Duration) time.Time {
+	next := schedule.Every(refresh).Next(time.Now())
+	for i := range files {
+		n := files[i].Next()
+		if !n.IsZero() && n.Before(next) {
+			next = n
+		}
+	}
+	return next
+}
+
+// fileSchedule returns the schedule for the given query. Queries without a
+// cron schedule run at every multiple of the refresh interval.
+func fileSchedule(q config.Query, refresh time.Duration) schedule.Schedule {
+	if q.Schedule == "" {
+		return schedule.Every(refresh)
+	}
+	s, err := schedule.Cron(q.Schedule, q.Timezone)
+	rtx.Must(err, "Invalid schedule for %q", q.File)
+	return s
+}
+
+// startDelay returns the delay before running the named query after a refresh
+// boundary. The delay is the sum of a deterministic offset in [0, stagger)
+// derived from the query name, which spreads different queries evenly, and a
+// random jitter in [0, jitter), which spreads the same query across replicas.
+func startDelay(name string, stagger, jitter time.Duration) time.Duration {
+	var d time.Duration
+	if stagger > 0 {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		d += time.Duration(h.Sum64() % uint64(stagger))
+	}
+	if jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(jitter)))
+	}
+	return d
+}
+
+// sleepContext sleeps for the given duration or until ctx is done. It reports
+// whether the full duration elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // fileToMetric extracts the base file name to use as a prometheus metric name.
+// Characters that are not allowed in metric names are replaced, so that
+// "ndt-tests.v2.sql" becomes "ndt_tests_v2".
 func fileToMetric(filename string) string {
 	fname := filepath.Base(filename)
-	return strings.TrimSuffix(fname, filepath.Ext(fname))
+	return sql.SanitizeName(strings.TrimSuffix(fname, filepath.Ext(fname)))
+}
+
+// validateFiles checks that the metric names, constant labels, and declared
+// columns for every file are valid, and that no two files report the same
+// metric name.
+func validateFiles(files []setup.File, namespace string) error {
+	seen := map[string]string{}
+	for i := range files {
+		name := namespace + fileToMetric(files[i].Name)
+		if !sql.ValidMetricName(name) {
+			return fmt.Errorf("%s: invalid metric name %q", files[i].Name, name)
+		}
+		if prev, ok := seen[name]; ok {
+			return fmt.Errorf("%s and %s both report metric %q", prev, files[i].Name, name)
+		}
+		seen[name] = files[i].Name
+		for k := range files[i].Config.Labels {
+			if !sql.ValidLabelName(k) {
+				return fmt.Errorf("%s: invalid constant label name %q", files[i].Name, k)
+			}
+		}
+		if d := files[i].Config.Driver; d != "" && !knownDriver(d) {
+			return fmt.Errorf("%s: unknown driver %q", files[i].Name, d)
+		}
+		if _, err := newCollector(nil, &files[i], name, ""); err != nil {
+			return fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// needsBigQuery reports whether any file runs its query in BigQuery.
+func needsBigQuery(files []setup.File) bool {
+	for i := range files {
+		if files[i].Config.Driver == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// knownDriver reports whether a database/sql driver with the given name is
+// registered.
+func knownDriver(name string) bool {
+	for _, d := range dbsql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
 }
 
 // fileToQuery reads the content of the given file and returns the query with template values repalced with those in vars.
@@ -85,71 +243,614 @@ func fileToQuery(filename string, vars map[string]string) string {
 	return q
 }
 
+// updateMode determines which files are run by updateFiles.
+type updateMode int
+
+const (
+	// updateDue registers new or modified files and updates files that are due.
+	updateDue updateMode = iota
+	// updateModified only registers new or modified files.
+	updateModified
+	// updateNow registers new or modified files and updates all other files
+	// immediately, ignoring their schedule, source tables, and start delay.
+	updateNow
+)
+
+// reloadRegisterUpdate registers new or modified files and updates every file
+// that is due according to its schedule. Once a file has run, its next update
+// is scheduled.
 func reloadRegisterUpdate(client *bigquery.Client, files []setup.File, vars map[string]string, keepAlive bool) {
+	updateFiles(client, files, vars, keepAlive, updateDue)
+}
+
+// updateFiles runs the given files concurrently according to mode, and returns
+// the files that ran.
+func updateFiles(client *bigquery.Client, files []setup.File, vars map[string]string, keepAlive bool, mode updateMode) []*setup.File {
 	var wg sync.WaitGroup
+	ran := make([]bool, len(files))
+	now := time.Now()
 	for i := range files {
 		wg.Add(1)
-		go func(f *setup.File) {
-			modified, err := f.IsModified()
-			start := time.Now()
-			if modified && err == nil {
-				c := sql.NewCollector(
-					newRunner(client), prometheus.GaugeValue,
-					fileToMetric(f.Name), fileToQuery(f.Name, vars))
-
-				log.Println("Registering:", fileToMetric(f.Name))
-				// NOTE: prometheus collector registration will fail when a file
-				// uses the same name but changes the metrics reported. Because
-				// this cannot be recovered, we use rtx.Must to exit and allow
-				// the runtime environment to restart.
-				err = f.Register(c)
-				if !keepAlive {
-					rtx.Must(f.Register(c), "Failed to register collector: aborting")
-				}
-			} else {
-				err = f.Update()
-				log.Println("Updating:", fileToMetric(f.Name), time.Since(start))
-			}
-			if err != nil {
-				failedFilesCounter.WithLabelValues(fileToMetric(f.Name)).Inc()
-				updateDuration.WithLabelValues(fileToMetric(f.Name), "failed").Observe(time.Since(start).Seconds())
-				log.Println("Error:", f.Name, err)
-			} else {
-				successFilesCounter.WithLabelValues(fileToMetric(f.Name)).Inc()
-				updateDuration.WithLabelValues(fileToMetric(f.Name), "success").Observe(time.Since(start).Seconds())
-			}
-			wg.Done()
-		}(&files[i])
+		go func(i int) {
+			defer wg.Done()
+			ran[i] = updateFile(client, &files[i], vars, keepAlive, now, mode)
+		}(i)
 	}
 	wg.Wait()
+	result := []*setup.File{}
+	for i := range files {
+		if ran[i] {
+			result = append(result, &files[i])
+		}
+	}
+	return result
 }
 
-var mainCtx, mainCancel = context.WithCancel(context.Background())
-var newRunner = func(client *bigquery.Client) sql.QueryRunner {
-	return query.NewBQRunner(client)
+// updateFile registers the given file if it is new or modified. Otherwise,
+// updateFile updates the file according to mode. updateFile reports whether
+// the file ran. updateFile holds the update lock of the file, except while it
+// waits for the start delay of a scheduled update.
+func updateFile(client *bigquery.Client, f *setup.File, vars map[string]string, keepAlive bool, now time.Time, mode updateMode) bool {
+	mux := updateMux(f.Name)
+	mux.Lock()
+	defer mux.Unlock()
+	modified, err := f.IsModified()
+	switch {
+	case modified && err == nil, mode == updateNow:
+		// Register new files and run forced updates immediately.
+	case mode == updateDue && f.Due(now):
+		var tc tableChecker
+		if bq, err2 := queryClient(client, f.Config); err2 != nil {
+			log.Println("Failed to create BigQuery client:", f.Name, err2)
+		} else {
+			tc = newTableChecker(bq, f.Config.Project)
+		}
+		checked := time.Now()
+		if sourcesUnchanged(tc, f) {
+			log.Println("Skipping:", fileToMetric(f.Name), "sources are unchanged")
+			skippedFilesCounter.WithLabelValues(fileToMetric(f.Name)).Inc()
+			// The cached results are as current as a new run would be.
+			f.RecordSkip(checked)
+			f.ScheduleNext(time.Now())
+			saveCache(*cacheDir, f)
+			return false
+		}
+		// Spread updates over time, but register new files immediately.
+		// Other updates of the file may run while this one waits.
+		mux.Unlock()
+		ok := sleepContext(mainCtx, startDelay(f.Name, *stagger, *jitter))
+		mux.Lock()
+		if !ok || !f.Due(now) {
+			// The context was canceled, or the file ran in the meantime.
+			return false
+		}
+	default:
+		// Nothing to do until the next scheduled update.
+		return false
+	}
+	release, err2 := limiter.Acquire(mainCtx, jobProject(f.Config))
+	if err2 != nil {
+		// The context was canceled while waiting to run.
+		return false
+	}
+	defer release()
+	start := time.Now()
+	restored := false
+	if modified && err == nil {
+		restored, err = registerFile(client, f, vars, keepAlive)
+	} else {
+		err = f.Update()
+		log.Println("Updating:", fileToMetric(f.Name), time.Since(start))
+	}
+	if restored && err == nil {
+		// No query ran, so there is no run to record.
+		f.RecordRestore(f.Results().Updated)
+		f.ScheduleNext(time.Now())
+		return true
+	}
+	f.RecordRun(start, err)
+	f.ScheduleNext(time.Now())
+	if err != nil {
+		failedFilesCounter.WithLabelValues(fileToMetric(f.Name)).Inc()
+		updateDuration.WithLabelValues(fileToMetric(f.Name), "failed").Observe(time.Since(start).Seconds())
+		log.Println("Error:", f.Name, err)
+	} else {
+		successFilesCounter.WithLabelValues(fileToMetric(f.Name)).Inc()
+		updateDuration.WithLabelValues(fileToMetric(f.Name), "success").Observe(time.Since(start).Seconds())
+		saveCache(*cacheDir, f)
+	}
+	return true
 }
 
-func main() {
-	flag.Parse()
-	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from env")
+// registerFile creates and registers a new collector for the given file. If the
+// registration fails, it is retried on the next update. registerFile reports
+// whether the collector was registered with cached results, without running
+// the query.
+func registerFile(client *bigquery.Client, f *setup.File, vars map[string]string, keepAlive bool) (bool, error) {
+	c, err := newFileCollector(client, f, vars)
+	if err != nil {
+		f.MarkModified()
+		return false, err
+	}
+	c.SetMaxStaleness(f.Config.MaxStaleness, f.Config.StalePolicy == config.StaleDrop)
+	c.SetAsync(*asyncRegister)
+	restored := restoreCache(*cacheDir, f, c)
+
+	log.Println("Registering:", fileToMetric(f.Name))
+	// NOTE: prometheus collector registration will fail when a file
+	// uses the same name but changes the metrics reported. Because
+	// this cannot be recovered, we use rtx.Must to exit and allow
+	// the runtime environment to restart.
+	err = f.Register(c)
+	if !keepAlive {
+		rtx.Must(f.Register(c), "Failed to register collector: aborting")
+	}
+	if err != nil {
+		f.MarkModified()
+	}
+	if err == nil && *asyncRegister && !restored {
+		// Registration did not run the query, so run it now.
+		err = f.Update()
+	}
+	return restored, err
+}
+
+// newFileCollector creates a collector for the given file, with the declared
+// columns of the file, if any.
+func newFileCollector(client *bigquery.Client, f *setup.File, vars map[string]string) (*sql.Collector, error) {
+	client, err := queryClient(client, f.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create BigQuery client: %v", err)
+	}
+	runner := newRunner(client, f.Config.Project)
+	if f.Config.Driver != "" {
+		db, err := openDB(f.Config.Driver, os.ExpandEnv(f.Config.DSN))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open database: %v", err)
+		}
+		runner = query.NewDBRunner(db)
+	}
+	return newCollector(runner, f, *namespace+fileToMetric(f.Name), fileToQuery(f.Name, vars))
+}
+
+// counterRunner is implemented by query runners that report exemplars only for
+// counter queries.
+type counterRunner interface {
+	SetCounter(counter bool)
+}
+
+// newCollector creates a collector for the given file that runs query with
+// runner and reports metrics with the given name. The collector declares the
+// columns of the file, if any.
+func newCollector(runner sql.QueryRunner, f *setup.File, name, query string) (*sql.Collector, error) {
+	valType := prometheus.GaugeValue
+	if f.Config.Type == config.TypeCounter {
+		valType = prometheus.CounterValue
+	}
+	if cr, ok := runner.(counterRunner); ok {
+		cr.SetCounter(valType == prometheus.CounterValue)
+	}
+	c := sql.NewCollector(runner, valType, name, query, f.Config.Labels)
+	c.SetUnit(f.Config.Unit)
+	if f.Config.Columns != nil {
+		if err := c.SetSchema(columnsToSchema(f.Config.Columns)); err != nil {
+			return nil, fmt.Errorf("invalid columns: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// tableChecker reports when tables were last modified.
+type tableChecker interface {
+	LastModified(ctx context.Context, tables []string) (time.Time, error)
+}
 
-	srv := prometheusx.MustServeMetrics()
-	defer srv.Shutdown(mainCtx)
+// openDB returns the database for the given driver and DSN. Databases are
+// opened once and shared by every query with the same driver and DSN, so that
+// queries share a connection pool.
+func openDB(driver, dsn string) (*dbsql.DB, error) {
+	dbsMux.Lock()
+	defer dbsMux.Unlock()
+	key := driver + " " + dsn
+	if db, ok := dbs[key]; ok {
+		return db, nil
+	}
+	db, err := dbsql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	dbs[key] = db
+	return db, nil
+}
 
-	files := make([]setup.File, len(gaugeSources))
+// checkClients creates the BigQuery clients for the client settings of every
+// file, so that invalid settings are reported at startup.
+func checkClients(client *bigquery.Client, files []setup.File) error {
 	for i := range files {
-		files[i].Name = gaugeSources[i]
+		if _, err := queryClient(client, files[i].Config); err != nil {
+			return fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// queryClient returns the BigQuery client for the client settings of the
+// query, or the given default client if the query has no client settings.
+// Clients are created once and shared by every query with the same settings.
+func queryClient(client *bigquery.Client, q config.Query) (*bigquery.Client, error) {
+	key := q.Client()
+	if key == (config.Client{}) {
+		return client, nil
+	}
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+	if c, ok := clients[key]; ok {
+		return c, nil
+	}
+	c, err := newClient(key)
+	if err != nil {
+		return nil, err
+	}
+	clients[key] = c
+	return c, nil
+}
+
+// jobProject returns the project that runs the query jobs of the query.
+func jobProject(q config.Query) string {
+	if p := q.Client().Project; p != "" {
+		return p
+	}
+	return *project
+}
+
+// sourcesUnchanged reports whether the file declares source tables and none of
+// them were modified since the start of the query for the current results.
+// If the tables cannot be checked, or tc is nil, sourcesUnchanged returns
+// false so that the query runs.
+func sourcesUnchanged(tc tableChecker, f *setup.File) bool {
+	r := f.Results()
+	if tc == nil || len(f.Config.Sources) == 0 || r == nil {
+		return false
 	}
+	modified, err := tc.LastModified(mainCtx, f.Config.Sources)
+	if err != nil {
+		log.Println("Failed to check sources:", f.Name, err)
+		return false
+	}
+	return modified.Before(r.Updated)
+}
+
+// columnsToSchema converts declared query columns to a sql.Schema, using the
+// same conventions as the query runners.
+func columnsToSchema(c *config.Columns) *sql.Schema {
+	s := &sql.Schema{}
+	s.LabelKeys = append(s.LabelKeys, c.Labels...)
+	for _, v := range c.Values {
+		s.ValueKeys = append(s.ValueKeys, strings.TrimPrefix(v, "value"))
+	}
+	sort.Strings(s.LabelKeys)
+	sort.Strings(s.ValueKeys)
+	return s
+}
+
+// fileToCacheKey returns the cache key for the current content of the given
+// query file, or the empty string if the file cannot be read.
+func fileToCacheKey(filename string) string {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	return cache.Key(b)
+}
+
+// restoreCache restores previously saved results for the given file into the
+// collector, so that registration does not need to run the query. Missing,
+// expired, or outdated results are ignored. restoreCache reports whether
+// results were restored.
+func restoreCache(dir string, f *setup.File, c *sql.Collector) bool {
+	if dir == "" {
+		return false
+	}
+	r, err := cache.Load(dir, fileToMetric(f.Name), fileToCacheKey(f.Name), *cacheMaxAge)
+	if err != nil {
+		logx.Debug.Println("Not restoring cache:", err)
+		return false
+	}
+	err = c.Restore(r)
+	if err != nil {
+		log.Println("Failed to restore cache:", f.Name, err)
+		return false
+	}
+	log.Println("Restored cache:", fileToMetric(f.Name), r.Updated)
+	return true
+}
+
+// saveCache saves the latest results for the given file.
+func saveCache(dir string, f *setup.File) {
+	r := f.Results()
+	if dir == "" || r == nil {
+		return
+	}
+	err := cache.Save(dir, fileToMetric(f.Name), fileToCacheKey(f.Name), r)
+	if err != nil {
+		log.Println("Failed to save cache:", f.Name, err)
+	}
+}
 
-	client, err := bigquery.NewClient(mainCtx, *project)
-	rtx.Must(err, "Failed to allocate a new bigquery.Client")
-	vars := map[string]string{
+// loadFiles creates a setup.File for every gauge and counter query named on the
+// command line and in the optional configuration file. Every unset query
+// setting is taken from the defaults, and the global labels are merged with
+// any query labels.
+func loadFiles(name string, gauges, counters []string, defaults config.Query) []setup.File {
+	queries := []config.Query{}
+	for i := range gauges {
+		queries = append(queries, config.Query{File: gauges[i]})
+	}
+	for i := range counters {
+		queries = append(queries, config.Query{File: counters[i], Type: config.TypeCounter})
+	}
+	if name != "" {
+		c, err := config.Load(name)
+		rtx.Must(err, "Failed to load config %q", name)
+		defaults.Labels = config.MergeLabels(c.Labels, defaults.Labels)
+		queries = append(queries, c.Queries...)
+	}
+	files := make([]setup.File, len(queries))
+	for i := range queries {
+		files[i].Name = queries[i].File
+		files[i].Config = queries[i].WithDefaults(defaults)
+		files[i].Schedule = fileSchedule(files[i].Config, *refresh)
+	}
+	return files
+}
+
+var mainCtx, mainCancel = context.WithCancel(context.Background())
+var limiter = limit.New(0, 0)
+var loopWatchdog = watchdog.New()
+
+// updateMuxes serializes scheduled updates and updates requested by the admin
+// handlers, which may otherwise register or update the same file concurrently.
+// The locks are keyed by file name, so that updates of other files proceed.
+var updateMuxes = map[string]*sync.Mutex{}
+var updateMuxesMux sync.Mutex
+
+// updateMux returns the update lock of the file with the given name.
+func updateMux(name string) *sync.Mutex {
+	updateMuxesMux.Lock()
+	defer updateMuxesMux.Unlock()
+	mux, ok := updateMuxes[name]
+	if !ok {
+		mux = &sync.Mutex{}
+		updateMuxes[name] = mux
+	}
+	return mux
+}
+
+// dbs holds the databases opened by openDB, keyed by driver and DSN.
+var dbs = map[string]*dbsql.DB{}
+var dbsMux sync.Mutex
+
+// clients holds the BigQuery clients created by queryClient, keyed by their
+// settings.
+var clients = map[config.Client]*bigquery.Client{}
+var clientsMux sync.Mutex
+
+var newRunner = func(client *bigquery.Client, project string) sql.QueryRunner {
+	qr := query.NewBQRunner(client)
+	if client != nil && project != "" && project != client.Project() {
+		qr.SetProject(project)
+	}
+	return qr
+}
+var newTableChecker = func(client *bigquery.Client, project string) tableChecker {
+	tc := query.NewTableChecker(client)
+	if project != "" {
+		tc.SetProject(project)
+	}
+	return tc
+}
+
+// newClient creates a BigQuery client with the given settings. Unset
+// settings use the -project and application default credentials.
+var newClient = func(key config.Client) (*bigquery.Client, error) {
+	creds := []option.ClientOption{}
+	if key.CredentialsFile != "" {
+		creds = append(creds, option.WithCredentialsFile(key.CredentialsFile))
+	}
+	if key.ImpersonateServiceAccount != "" {
+		// The credentials file, if any, is used to impersonate the account.
+		ts, err := impersonate.CredentialsTokenSource(mainCtx, impersonate.CredentialsConfig{
+			TargetPrincipal: key.ImpersonateServiceAccount,
+			Scopes:          []string{bigquery.Scope},
+		}, creds...)
+		if err != nil {
+			return nil, err
+		}
+		creds = []option.ClientOption{option.WithTokenSource(ts)}
+	}
+	opts := append(bigqueryOptions(), creds...)
+	p := key.Project
+	if p == "" {
+		p = *project
+	}
+	c, err := bigquery.NewClient(mainCtx, p, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.Location = key.Location
+	return c, nil
+}
+
+// exportMetrics writes the metrics from g to the -textfile-dir and pushes them
+// to the -push-url, if configured.
+func exportMetrics(g prometheus.Gatherer) error {
+	if *textfileDir != "" {
+		err := writeTextfile(*textfileDir, g)
+		if err != nil {
+			return fmt.Errorf("failed to write textfile: %v", err)
+		}
+	}
+	if *pushURL != "" {
+		err := pushMetrics(*pushURL, *pushJob, pushGrouping.Get(), g)
+		if err != nil {
+			return fmt.Errorf("failed to push metrics: %v", err)
+		}
+	}
+	return nil
+}
+
+// bigqueryOptions returns the client options for the -bigquery-endpoint and
+// -no-auth flags.
+func bigqueryOptions() []option.ClientOption {
+	opts := []option.ClientOption{}
+	if *bqEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(*bqEndpoint))
+	}
+	if *noAuth {
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	return opts
+}
+
+// templateVars returns the values of the template variables in queries.
+func templateVars() map[string]string {
+	return map[string]string{
 		"UNIX_START_TIME":  fmt.Sprintf("%d", time.Now().UTC().Unix()),
 		"REFRESH_RATE_SEC": fmt.Sprintf("%d", int(refresh.Seconds())),
 	}
+}
+
+// runValidate checks the given files with validateQueries, prints every
+// problem found, and returns the exit status. When a BigQuery client is
+// available for the -project, queries are checked with a dry run. Otherwise,
+// queries are parsed locally.
+func runValidate(files []setup.File) int {
+	columns := parseColumns
+	if *project == "" {
+		log.Println("Using local parse instead of a dry run: no -project")
+	} else if client, err := bigquery.NewClient(mainCtx, *project, bigqueryOptions()...); err != nil {
+		log.Println("Using local parse instead of a dry run:", err)
+	} else {
+		columns = func(q string) ([]string, bool, error) {
+			names, err := query.DryRunColumns(mainCtx, client, q)
+			return names, true, err
+		}
+	}
+	problems := validateQueries(files, *namespace, templateVars(), columns)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Printf("%d query files OK\n", len(files))
+	return 0
+}
+
+func main() {
+	// The optional "validate" command checks the query files and exits.
+	args := os.Args[1:]
+	validate := len(args) > 0 && args[0] == "validate"
+	if validate {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not get args from env")
+
+	defaults := config.Query{
+		Labels:       constLabels.Get(),
+		MaxStaleness: *maxStaleness,
+		StalePolicy:  *stalePolicy,
+	}
+	rtx.Must(defaults.Validate(), "Invalid -stale-policy or -max-staleness")
+	files := loadFiles(*configFile, gaugeSources, counterSources, defaults)
+	if validate {
+		os.Exit(runValidate(files))
+	}
+	rtx.Must(validateFiles(files, *namespace), "Invalid query configuration")
+
+	if *stagger+*jitter >= *refresh {
+		log.Fatalf("-stagger plus -jitter (%v) must be less than -refresh (%v)", *stagger+*jitter, *refresh)
+	}
+	limiter = limit.New(*maxQueries, *maxPerProject)
+	prometheus.MustRegister(sql.Staleness)
+
+	var client *bigquery.Client
+	var err error
+	if len(fixtures) > 0 {
+		db, err := query.OpenFixtures(fixtures...)
+		rtx.Must(err, "Failed to load fixtures")
+		newRunner = func(*bigquery.Client, string) sql.QueryRunner {
+			return query.NewDBRunner(db)
+		}
+		// Source tables only exist in BigQuery.
+		newTableChecker = func(*bigquery.Client, string) tableChecker {
+			return nil
+		}
+		newClient = func(config.Client) (*bigquery.Client, error) {
+			return nil, nil
+		}
+	} else if needsBigQuery(files) {
+		client, err = bigquery.NewClient(mainCtx, *project, bigqueryOptions()...)
+		rtx.Must(err, "Failed to allocate a new bigquery.Client")
+	}
+	rtx.Must(checkClients(client, files), "Invalid client settings")
+	vars := templateVars()
+	if *once {
+		reg, err := runOnce(client, files, vars)
+		rtx.Must(writeMetrics(os.Stdout, *onceFormat, reg), "Failed to write metrics")
+		rtx.Must(exportMetrics(reg), "Failed to export metrics")
+		rtx.Must(err, "Failed to run queries")
+		return
+	}
+	update := func(files []setup.File, mode updateMode) []*setup.File {
+		return updateFiles(client, files, vars, *keepAlive, mode)
+	}
+	if *prometheusx.ListenAddress != "" {
+		srv := mustServe(*prometheusx.ListenAddress, files, *adminToken, update)
+		defer srv.Shutdown(mainCtx)
+	}
+
+	var remote *remoteWriter
+	if *remoteURL != "" {
+		rc := remotewrite.New(*remoteURL)
+		rc.Headers = remoteHeaders.Get()
+		rc.BatchSize = *remoteBatch
+		rc.Retries = *remoteRetries
+		remote = newRemoteWriter(rc)
+	}
+	var otlp *otlpWriter
+	if *otlpEndpoint != "" {
+		exp, err := newOTLPExporter(mainCtx, *otlpProtocol, *otlpEndpoint, *otlpInsecure, otlpHeaders.Get())
+		rtx.Must(err, "Failed to create OTLP exporter")
+		defer exp.Shutdown(context.Background())
+		otlp = newOTLPWriter(exp, *project)
+	}
 
 	for mainCtx.Err() == nil {
+		// The loop is wedged if updates or sleep take longer than expected.
+		loopWatchdog.Kick(*watchdogTime)
 		reloadRegisterUpdate(client, files, vars, *keepAlive)
-		sleepUntilNext(*refresh)
+		err = exportMetrics(setup.NewGatherer(files))
+		if err != nil {
+			log.Println("Failed to export metrics:", err)
+		}
+		if remote != nil {
+			err = remote.write(mainCtx, files)
+			if err != nil {
+				log.Println("Failed to remote write:", err)
+			}
+		}
+		if otlp != nil {
+			err = otlp.write(mainCtx, files)
+			if err != nil {
+				log.Println("Failed to export OTLP metrics:", err)
+			}
+		}
+		next := nextWakeup(files, *refresh)
+		if *watchdogTime > 0 {
+			loopWatchdog.Kick(time.Until(next) + *watchdogTime)
+		}
+		sleepContext(mainCtx, time.Until(next))
 	}
 }
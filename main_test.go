@@ -10,13 +10,23 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/limit"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/schedule"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func init() {
@@ -51,13 +61,11 @@ func Test_main(t *testing.T) {
 	defer os.Remove(tmp.Name())
 
 	// Provide coverage of the original newRunner definition.
-	newRunner(nil)
+	newRunner(nil, "")
 
 	// Create a fake runner for the test.
 	f := &fakeRunner{}
-	newRunner = func(*bigquery.Client) sql.QueryRunner {
-		return f
-	}
+	withFakeRunner(t, f)
 
 	// Set the refresh period to a very small delay.
 	*refresh = time.Second
@@ -74,3 +82,699 @@ func Test_main(t *testing.T) {
 		t.Errorf("main() failed to update; got %d, want 2", f.updated)
 	}
 }
+
+func Test_loadFiles(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "config_*.yml")
+	rtx.Must(err, "Failed to create temp file for loadFiles test.")
+	defer os.Remove(tmp.Name())
+	tmp.WriteString(`
+labels:
+  env: staging
+  team: ops
+queries:
+  - file: other.sql
+    labels:
+      team: dev
+`)
+	tmp.Close()
+
+	files := loadFiles(tmp.Name(), []string{"example.sql"}, []string{"counter.sql"}, config.Query{
+		Labels:       map[string]string{"env": "prod"},
+		MaxStaleness: time.Hour,
+	})
+	if len(files) != 3 {
+		t.Fatalf("loadFiles() returned %d files, want 3", len(files))
+	}
+	if files[0].Config.Type != "" || files[1].Config.Type != config.TypeCounter {
+		t.Errorf("loadFiles() types = %q, %q, want gauge and counter", files[0].Config.Type, files[1].Config.Type)
+	}
+	want := []map[string]string{
+		{"env": "prod", "team": "ops"},
+		{"env": "prod", "team": "ops"},
+		{"env": "prod", "team": "dev"},
+	}
+	for i := range files {
+		if !reflect.DeepEqual(files[i].Config.Labels, want[i]) {
+			t.Errorf("loadFiles() %s labels = %v, want %v", files[i].Name, files[i].Config.Labels, want[i])
+		}
+		if files[i].Config.MaxStaleness != time.Hour {
+			t.Errorf("loadFiles() %s max staleness = %v, want 1h", files[i].Name, files[i].Config.MaxStaleness)
+		}
+	}
+}
+
+func Test_fileToMetric(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{filename: "/queries/bq_ndt_test.sql", want: "bq_ndt_test"},
+		{filename: "/queries/ndt-tests.v2.sql", want: "ndt_tests_v2"},
+	}
+	for _, tt := range tests {
+		if got := fileToMetric(tt.filename); got != tt.want {
+			t.Errorf("fileToMetric(%q) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
+
+func Test_validateFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     []setup.File
+		namespace string
+		wantErr   bool
+	}{
+		{
+			name:      "success",
+			files:     []setup.File{{Name: "a.sql", Config: config.Query{Labels: map[string]string{"env": "prod"}}}, {Name: "b.sql"}},
+			namespace: "bqx_",
+		},
+		{
+			name:    "error-collision",
+			files:   []setup.File{{Name: "ndt-tests.sql"}, {Name: "other/ndt_tests.sql"}},
+			wantErr: true,
+		},
+		{
+			name:      "error-namespace",
+			files:     []setup.File{{Name: "a.sql"}},
+			namespace: "bqx-",
+			wantErr:   true,
+		},
+		{
+			name:    "error-label",
+			files:   []setup.File{{Name: "a.sql", Config: config.Query{Labels: map[string]string{"bad-label": "x"}}}},
+			wantErr: true,
+		},
+		{
+			name:  "success-driver",
+			files: []setup.File{{Name: "a.sql", Config: config.Query{Driver: "postgres", DSN: "postgres://db/ops"}}},
+		},
+		{
+			name:    "error-driver",
+			files:   []setup.File{{Name: "a.sql", Config: config.Query{Driver: "oracle", DSN: "oracle://db/ops"}}},
+			wantErr: true,
+		},
+		{
+			name: "success-columns",
+			files: []setup.File{{Name: "a.sql", Config: config.Query{
+				Columns: &config.Columns{Labels: []string{"site"}, Values: []string{"value"}},
+			}}},
+		},
+		{
+			name: "error-columns",
+			files: []setup.File{{Name: "a.sql", Config: config.Query{
+				Labels:  map[string]string{"site": "x"},
+				Columns: &config.Columns{Labels: []string{"site"}, Values: []string{"value"}},
+			}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateFiles(tt.files, tt.namespace); (err != nil) != tt.wantErr {
+				t.Errorf("validateFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// counterFakeRunner records whether the runner is configured for counters.
+type counterFakeRunner struct {
+	counter bool
+}
+
+func (r *counterFakeRunner) Query(string) ([]sql.Metric, error) { return nil, nil }
+func (r *counterFakeRunner) SetCounter(counter bool)            { r.counter = counter }
+
+func Test_newCollector_counter(t *testing.T) {
+	for _, typ := range []string{config.TypeGauge, config.TypeCounter} {
+		r := &counterFakeRunner{}
+		f := &setup.File{Name: "a.sql", Config: config.Query{Type: typ}}
+		if _, err := newCollector(r, f, "a", ""); err != nil {
+			t.Fatalf("newCollector() error = %v", err)
+		}
+		if r.counter != (typ == config.TypeCounter) {
+			t.Errorf("newCollector(%s) counter = %v, want %v", typ, r.counter, typ == config.TypeCounter)
+		}
+	}
+}
+
+func Test_openDB(t *testing.T) {
+	a, err := openDB("postgres", "postgres://db/ops")
+	rtx.Must(err, "Failed to open database")
+	b, err := openDB("postgres", "postgres://db/ops")
+	rtx.Must(err, "Failed to open database")
+	c, err := openDB("mysql", "exporter@tcp(db)/ops")
+	rtx.Must(err, "Failed to open database")
+	if a != b || a == c {
+		t.Errorf("openDB() must share databases with the same driver and DSN")
+	}
+	if _, err := openDB("oracle", "oracle://db/ops"); err == nil {
+		t.Errorf("openDB() expected error for unknown driver")
+	}
+}
+
+func Test_saveRestoreCache(t *testing.T) {
+	dir := t.TempDir()
+	name := tempQueryFile(t)
+	rtx.Must(ioutil.WriteFile(name, []byte("SELECT 1 AS value"), 0644), "Failed to write file")
+
+	f := &setup.File{Name: name}
+	c := sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, fileToMetric(f.Name), "", nil)
+	rtx.Must(f.Register(c), "Failed to register collector")
+	defer prometheus.Unregister(c)
+	saveCache(dir, f)
+
+	// Restore the saved results into a new collector.
+	r := &fakeRunner{}
+	c2 := sql.NewCollector(r, prometheus.GaugeValue, fileToMetric(f.Name), "", nil)
+	restoreCache(dir, f, c2)
+	got := c2.Results()
+	if got == nil || !reflect.DeepEqual(got.Metrics, f.Results().Metrics) {
+		t.Errorf("restoreCache() = %#v, want %#v", got, f.Results())
+	}
+
+	// Modifying the query invalidates the saved results.
+	rtx.Must(ioutil.WriteFile(name, []byte("SELECT 2 AS value"), 0644), "Failed to write file")
+	c3 := sql.NewCollector(r, prometheus.GaugeValue, fileToMetric(f.Name), "", nil)
+	restoreCache(dir, f, c3)
+	if c3.Results() != nil {
+		t.Errorf("restoreCache() = %#v, want nil", c3.Results())
+	}
+}
+
+func Test_columnsToSchema(t *testing.T) {
+	got := columnsToSchema(&config.Columns{
+		Labels: []string{"site", "machine"},
+		Values: []string{"value_count", "value"},
+	})
+	want := &sql.Schema{
+		LabelKeys: []string{"machine", "site"},
+		ValueKeys: []string{"", "_count"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("columnsToSchema() = %#v, want %#v", got, want)
+	}
+}
+
+// concurrentRunner records the maximum number of concurrent queries.
+type concurrentRunner struct {
+	running, max *int64
+}
+
+func (r *concurrentRunner) Query(query string) ([]sql.Metric, error) {
+	n := atomic.AddInt64(r.running, 1)
+	defer atomic.AddInt64(r.running, -1)
+	for m := atomic.LoadInt64(r.max); n > m; m = atomic.LoadInt64(r.max) {
+		atomic.CompareAndSwapInt64(r.max, m, n)
+	}
+	time.Sleep(10 * time.Millisecond)
+	return []sql.Metric{sql.NewMetric(nil, nil, map[string]float64{"": 1})}, nil
+}
+
+// withFakeRunner replaces newRunner with a function that returns r, and
+// mainCtx with a background context, until the test completes.
+func withFakeRunner(t *testing.T, r sql.QueryRunner) {
+	t.Helper()
+	origRunner, origCtx := newRunner, mainCtx
+	t.Cleanup(func() { newRunner, mainCtx = origRunner, origCtx })
+	newRunner = func(*bigquery.Client, string) sql.QueryRunner {
+		return r
+	}
+	mainCtx = context.Background()
+}
+
+// tempQueryFile creates an empty query file, removed when the test completes,
+// and returns its name.
+func tempQueryFile(t *testing.T) string {
+	t.Helper()
+	tmp, err := ioutil.TempFile("", "query_*.sql")
+	rtx.Must(err, "Failed to create temp file")
+	tmp.Close()
+	t.Cleanup(func() { os.Remove(tmp.Name()) })
+	return tmp.Name()
+}
+
+func Test_reloadRegisterUpdate_limit(t *testing.T) {
+	var running, max int64
+	withFakeRunner(t, &concurrentRunner{running: &running, max: &max})
+	origLimiter := limiter
+	defer func() { limiter = origLimiter }()
+	limiter = limit.New(1, 0)
+
+	files := make([]setup.File, 3)
+	for i := range files {
+		files[i].Name = tempQueryFile(t)
+	}
+	reloadRegisterUpdate(nil, files, map[string]string{}, true)
+	for i := range files {
+		if s := files[i].Status(); s.Runs != 1 || s.LastError != nil {
+			t.Errorf("reloadRegisterUpdate() %s status = %#v, want one successful run", files[i].Name, s)
+		}
+	}
+	if max != 1 {
+		t.Errorf("reloadRegisterUpdate() ran %d concurrent queries, want 1", max)
+	}
+}
+
+func Test_startDelay(t *testing.T) {
+	if d := startDelay("a.sql", 0, 0); d != 0 {
+		t.Errorf("startDelay() = %v, want 0", d)
+	}
+	// The stagger offset is deterministic and within the window.
+	d1 := startDelay("a.sql", time.Minute, 0)
+	d2 := startDelay("a.sql", time.Minute, 0)
+	if d1 != d2 || d1 < 0 || d1 >= time.Minute {
+		t.Errorf("startDelay() = %v, %v; want equal values in [0, 1m)", d1, d2)
+	}
+	if d3 := startDelay("b.sql", time.Minute, 0); d3 == d1 {
+		t.Errorf("startDelay() = %v for different names, want different offsets", d3)
+	}
+	for i := 0; i < 100; i++ {
+		d := startDelay("a.sql", time.Minute, time.Second)
+		if d < d1 || d >= d1+time.Second {
+			t.Errorf("startDelay() = %v, want in [%v, %v)", d, d1, d1+time.Second)
+		}
+	}
+}
+
+func Test_sleepContext(t *testing.T) {
+	if !sleepContext(context.Background(), time.Millisecond) {
+		t.Errorf("sleepContext() = false, want true")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sleepContext(ctx, time.Hour) {
+		t.Errorf("sleepContext() = true for canceled context, want false")
+	}
+}
+
+func Test_nextWakeup(t *testing.T) {
+	soon := time.Now().Add(time.Second)
+	files := []setup.File{
+		{Name: "a.sql", Schedule: schedule.Every(time.Hour)},
+		{Name: "b.sql"},
+	}
+	// Without scheduled updates, wake up at the next refresh.
+	got := nextWakeup(files, time.Hour)
+	if want := schedule.Every(time.Hour).Next(time.Now()); !got.Equal(want) {
+		t.Errorf("nextWakeup() = %v, want %v", got, want)
+	}
+	files[0].Schedule = schedule.Every(time.Second)
+	files[0].ScheduleNext(time.Now())
+	if got := nextWakeup(files, time.Hour); got.After(soon) {
+		t.Errorf("nextWakeup() = %v, want before %v", got, soon)
+	}
+}
+
+func Test_fileSchedule(t *testing.T) {
+	now := time.Date(2023, 4, 1, 10, 7, 30, 0, time.UTC)
+	s := fileSchedule(config.Query{File: "a.sql"}, 5*time.Minute)
+	if got, want := s.Next(now), time.Date(2023, 4, 1, 10, 10, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("fileSchedule().Next() = %v, want %v", got, want)
+	}
+	s = fileSchedule(config.Query{File: "a.sql", Schedule: "15 2 * * *", Timezone: "UTC"}, 5*time.Minute)
+	if got, want := s.Next(now), time.Date(2023, 4, 2, 2, 15, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("fileSchedule().Next() = %v, want %v", got, want)
+	}
+}
+
+func Test_reloadRegisterUpdate_schedule(t *testing.T) {
+	var running, max int64
+	withFakeRunner(t, &concurrentRunner{running: &running, max: &max})
+	files := []setup.File{{Name: tempQueryFile(t), Schedule: schedule.Every(time.Hour)}}
+
+	// The first call registers the file, and the second call does nothing
+	// because the next update is scheduled in the future.
+	reloadRegisterUpdate(nil, files, map[string]string{}, true)
+	reloadRegisterUpdate(nil, files, map[string]string{}, true)
+	if s := files[0].Status(); s.Runs != 1 {
+		t.Errorf("reloadRegisterUpdate() ran %d times, want 1", s.Runs)
+	}
+	if files[0].Next().Before(time.Now()) {
+		t.Errorf("reloadRegisterUpdate() next = %v, want a future time", files[0].Next())
+	}
+}
+
+type fakeTableChecker struct {
+	modified time.Time
+	err      error
+}
+
+func (f *fakeTableChecker) LastModified(ctx context.Context, tables []string) (time.Time, error) {
+	return f.modified, f.err
+}
+
+func Test_sourcesUnchanged(t *testing.T) {
+	f := &setup.File{Name: "a.sql", Config: config.Query{Sources: []string{"ndt.downloads"}}}
+	c := sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, "sources_unchanged", "", nil)
+	rtx.Must(f.Register(c), "Failed to register collector")
+	defer prometheus.Unregister(c)
+	updated := f.Results().Updated
+
+	tests := []struct {
+		name string
+		f    *setup.File
+		tc   *fakeTableChecker
+		want bool
+	}{
+		{
+			name: "unchanged",
+			f:    f,
+			tc:   &fakeTableChecker{modified: updated.Add(-time.Hour)},
+			want: true,
+		},
+		{
+			name: "changed",
+			f:    f,
+			tc:   &fakeTableChecker{modified: updated.Add(time.Second)},
+		},
+		{
+			name: "error",
+			f:    f,
+			tc:   &fakeTableChecker{err: fmt.Errorf("fake error")},
+		},
+		{
+			name: "no-sources",
+			f:    &setup.File{Name: "b.sql"},
+			tc:   &fakeTableChecker{modified: updated.Add(-time.Hour)},
+		},
+		{
+			name: "no-results",
+			f:    &setup.File{Name: "c.sql", Config: config.Query{Sources: []string{"ndt.downloads"}}},
+			tc:   &fakeTableChecker{modified: updated.Add(-time.Hour)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sourcesUnchanged(tt.tc, tt.f); got != tt.want {
+				t.Errorf("sourcesUnchanged() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+	// Without a table checker, sources are never unchanged.
+	if sourcesUnchanged(nil, f) {
+		t.Errorf("sourcesUnchanged(nil) = true, want false")
+	}
+}
+
+func Test_needsBigQuery(t *testing.T) {
+	files := []setup.File{
+		{Name: "a.sql", Config: config.Query{Driver: "postgres", DSN: "postgres://db/ops"}},
+		{Name: "b.sql"},
+	}
+	if needsBigQuery(files[:1]) {
+		t.Errorf("needsBigQuery() = true, want false for database queries")
+	}
+	if !needsBigQuery(files) {
+		t.Errorf("needsBigQuery() = false, want true")
+	}
+}
+
+func Test_reloadRegisterUpdate_sources(t *testing.T) {
+	var running, max int64
+	withFakeRunner(t, &concurrentRunner{running: &running, max: &max})
+	origChecker := newTableChecker
+	defer func() { newTableChecker = origChecker }()
+	newTableChecker = func(*bigquery.Client, string) tableChecker {
+		return &fakeTableChecker{modified: time.Now().Add(-time.Hour)}
+	}
+	files := []setup.File{{Name: tempQueryFile(t), Config: config.Query{Sources: []string{"ndt.downloads"}}}}
+
+	// The first call registers the file, and the second call skips the
+	// update because the source table is unchanged.
+	reloadRegisterUpdate(nil, files, map[string]string{}, true)
+	updated := files[0].Results().Updated
+	reloadRegisterUpdate(nil, files, map[string]string{}, true)
+	if s := files[0].Status(); s.Runs != 1 || s.Skips != 1 {
+		t.Errorf("reloadRegisterUpdate() ran %d times and skipped %d, want 1 and 1", s.Runs, s.Skips)
+	}
+	// The skipped run keeps the cached results current.
+	if r := files[0].Results(); !r.Updated.After(updated) {
+		t.Errorf("reloadRegisterUpdate() results updated %v, want after %v", r.Updated, updated)
+	}
+}
+
+func Test_updateFiles_modes(t *testing.T) {
+	var running, max int64
+	withFakeRunner(t, &concurrentRunner{running: &running, max: &max})
+	files := []setup.File{{Name: tempQueryFile(t), Schedule: schedule.Every(time.Hour)}}
+
+	tests := []struct {
+		name     string
+		mode     updateMode
+		wantRan  int
+		wantRuns int
+	}{
+		{name: "modified-registers", mode: updateModified, wantRan: 1, wantRuns: 1},
+		{name: "modified-skips-unmodified", mode: updateModified, wantRan: 0, wantRuns: 1},
+		{name: "due-skips-scheduled", mode: updateDue, wantRan: 0, wantRuns: 1},
+		{name: "now-ignores-schedule", mode: updateNow, wantRan: 1, wantRuns: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := updateFiles(nil, files, map[string]string{}, true, tt.mode)
+			if len(ran) != tt.wantRan {
+				t.Errorf("updateFiles() ran %d files, want %d", len(ran), tt.wantRan)
+			}
+			if s := files[0].Status(); s.Runs != tt.wantRuns {
+				t.Errorf("updateFiles() runs = %d, want %d", s.Runs, tt.wantRuns)
+			}
+		})
+	}
+}
+
+func Test_updateFiles_registerError(t *testing.T) {
+	var running, max int64
+	withFakeRunner(t, &concurrentRunner{running: &running, max: &max})
+
+	tests := []struct {
+		name   string
+		config config.Query
+		// conflict registers a metric with the same name as the query.
+		conflict bool
+	}{
+		{
+			// The label column conflicts with a constant label.
+			name: "columns",
+			config: config.Query{
+				Labels:  map[string]string{"site": "x"},
+				Columns: &config.Columns{Labels: []string{"site"}, Values: []string{"value"}},
+			},
+		},
+		{
+			// Another collector reports the metric with other labels.
+			name: "register",
+			config: config.Query{
+				Columns: &config.Columns{Labels: []string{"site"}, Values: []string{"value"}},
+			},
+			conflict: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := tempQueryFile(t)
+			files := []setup.File{{Name: name, Config: tt.config}}
+			if tt.conflict {
+				g := prometheus.NewGauge(prometheus.GaugeOpts{Name: fileToMetric(name), Help: "conflict"})
+				prometheus.MustRegister(g)
+				defer prometheus.Unregister(g)
+			}
+
+			// The failed registration is recorded and retried.
+			for i := 1; i <= 2; i++ {
+				updateFiles(nil, files, map[string]string{}, true, updateModified)
+				s := files[0].Status()
+				if s.Runs != i || s.LastError == nil || !s.LastSuccess.IsZero() {
+					t.Errorf("updateFiles() status = %#v, want %d failed runs", s, i)
+				}
+			}
+			// Updates of the unregistered file fail.
+			updateFiles(nil, files, map[string]string{}, true, updateNow)
+			if s := files[0].Status(); s.LastError == nil || !s.LastSuccess.IsZero() {
+				t.Errorf("updateFiles() status = %#v, want a failed run", s)
+			}
+		})
+	}
+}
+
+func Test_updateFiles_restored(t *testing.T) {
+	var running, max int64
+	withFakeRunner(t, &concurrentRunner{running: &running, max: &max})
+	origDir := *cacheDir
+	defer func() { *cacheDir = origDir }()
+	dir := t.TempDir()
+	*cacheDir = dir
+	name := tempQueryFile(t)
+	metric := fileToMetric(name)
+
+	// Save the results of a previous run.
+	prev := &setup.File{Name: name}
+	c := sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, metric, "", nil)
+	rtx.Must(prev.Register(c), "Failed to register collector")
+	saveCache(dir, prev)
+	prometheus.Unregister(c)
+
+	files := []setup.File{{Name: name}}
+	ran := updateFiles(nil, files, map[string]string{}, true, updateModified)
+	if len(ran) != 1 {
+		t.Errorf("updateFiles() ran %d files, want 1", len(ran))
+	}
+	// The restore runs no query, and is not recorded as a run.
+	if max != 0 {
+		t.Errorf("updateFiles() ran the query, want restored results")
+	}
+	s := files[0].Status()
+	if s.Runs != 0 || !s.LastSuccess.IsZero() || !s.Restored.Equal(prev.Results().Updated) {
+		t.Errorf("updateFiles() status = %#v, want only restored results", s)
+	}
+	if n := testutil.ToFloat64(successFilesCounter.WithLabelValues(metric)); n != 0 {
+		t.Errorf("updateFiles() success count = %v, want 0", n)
+	}
+}
+
+func Test_updateFiles_delayUnlocked(t *testing.T) {
+	var running, max int64
+	withFakeRunner(t, &concurrentRunner{running: &running, max: &max})
+	origJitter := *jitter
+	defer func() { *jitter = origJitter }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mainCtx = ctx
+
+	// Without a schedule, the file is always due.
+	files := []setup.File{{Name: tempQueryFile(t)}}
+	updateFiles(nil, files, map[string]string{}, true, updateModified)
+
+	// The scheduled update waits for its start delay.
+	*jitter = time.Hour
+	done := make(chan []*setup.File)
+	go func() {
+		done <- updateFiles(nil, files, map[string]string{}, true, updateDue)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// A forced update does not wait for the scheduled update.
+	ran := updateFiles(nil, files, map[string]string{}, true, updateNow)
+	if len(ran) != 1 {
+		t.Errorf("updateFiles() ran %d files, want 1", len(ran))
+	}
+	cancel()
+	if ran := <-done; len(ran) != 0 {
+		t.Errorf("updateFiles() ran %d files after cancel, want 0", len(ran))
+	}
+	if s := files[0].Status(); s.Runs != 2 {
+		t.Errorf("updateFiles() runs = %d, want 2", s.Runs)
+	}
+}
+
+func Test_bigqueryOptions(t *testing.T) {
+	// A stand-in for an emulator that records the requested paths.
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("request has Authorization header, want none")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": "test-project:ops"}`)
+	}))
+	defer srv.Close()
+
+	origEndpoint, origNoAuth := *bqEndpoint, *noAuth
+	defer func() { *bqEndpoint, *noAuth = origEndpoint, origNoAuth }()
+	*bqEndpoint = srv.URL
+	*noAuth = true
+
+	client, err := bigquery.NewClient(context.Background(), "test-project", bigqueryOptions()...)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Dataset("ops").Metadata(context.Background()); err != nil {
+		t.Errorf("Metadata() error = %v", err)
+	}
+	want := []string{"/projects/test-project/datasets/ops"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("requested paths = %q, want %q", paths, want)
+	}
+
+	*bqEndpoint, *noAuth = "", false
+	if got := bigqueryOptions(); len(got) != 0 {
+		t.Errorf("bigqueryOptions() = %d options, want none", len(got))
+	}
+}
+
+func Test_queryClient(t *testing.T) {
+	origNoAuth, origProject, origClients := *noAuth, *project, clients
+	defer func() { *noAuth, *project, clients = origNoAuth, origProject, origClients }()
+	*noAuth = true
+	*project = "mlab-sandbox"
+	clients = map[config.Client]*bigquery.Client{}
+
+	def, err := newClient(config.Client{})
+	rtx.Must(err, "Failed to create default client")
+	got, err := queryClient(def, config.Query{File: "a.sql", Sources: []string{"ndt.downloads"}})
+	if err != nil || got != def {
+		t.Errorf("queryClient() = %p, %v, want default client %p", got, err, def)
+	}
+	q := config.Query{File: "b.sql", Project: "mlab-oti", BillingProject: "mlab-billing", Location: "EU"}
+	eu, err := queryClient(def, q)
+	if err != nil {
+		t.Fatalf("queryClient() error = %v", err)
+	}
+	if eu.Project() != "mlab-billing" || eu.Location != "EU" {
+		t.Errorf("queryClient() project = %q, location = %q, want mlab-billing, EU", eu.Project(), eu.Location)
+	}
+	again, err := queryClient(def, config.Query{File: "c.sql", BillingProject: "mlab-billing", Location: "EU"})
+	if err != nil || again != eu {
+		t.Errorf("queryClient() = %p, %v, want shared client %p", again, err, eu)
+	}
+	us, err := queryClient(def, config.Query{File: "d.sql", Location: "US"})
+	if err != nil || us == eu || us.Project() != "mlab-sandbox" {
+		t.Errorf("queryClient() = %p, %v, want new client for mlab-sandbox", us, err)
+	}
+	if len(clients) != 2 {
+		t.Errorf("queryClient() created %d clients, want 2", len(clients))
+	}
+}
+
+func Test_checkClients(t *testing.T) {
+	origNewClient, origClients := newClient, clients
+	defer func() { newClient, clients = origNewClient, origClients }()
+	clients = map[config.Client]*bigquery.Client{}
+	newClient = func(key config.Client) (*bigquery.Client, error) {
+		if key.CredentialsFile == "missing.json" {
+			return nil, fmt.Errorf("fake error")
+		}
+		return nil, nil
+	}
+	files := []setup.File{{Name: "a.sql"}, {Name: "b.sql", Config: config.Query{Location: "EU"}}}
+	if err := checkClients(nil, files); err != nil {
+		t.Errorf("checkClients() error = %v, want nil", err)
+	}
+	files = append(files, setup.File{Name: "c.sql", Config: config.Query{CredentialsFile: "missing.json"}})
+	if err := checkClients(nil, files); err == nil {
+		t.Errorf("checkClients() error = nil, want an error")
+	}
+}
+
+func Test_jobProject(t *testing.T) {
+	origProject := *project
+	defer func() { *project = origProject }()
+	*project = "mlab-sandbox"
+	tests := []struct {
+		q    config.Query
+		want string
+	}{
+		{q: config.Query{File: "a.sql"}, want: "mlab-sandbox"},
+		{q: config.Query{File: "a.sql", Project: "mlab-oti"}, want: "mlab-oti"},
+		{q: config.Query{File: "a.sql", Project: "mlab-oti", BillingProject: "mlab-billing"}, want: "mlab-billing"},
+	}
+	for _, tt := range tests {
+		if got := jobProject(tt.q); got != tt.want {
+			t.Errorf("jobProject(%#v) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
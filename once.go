@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Output formats for writeMetrics.
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// sample is a single metric value in the json output of writeMetrics.
+type sample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// runOnce runs every file once and returns a registry with the results of
+// the successful queries. runOnce returns an error if any query fails.
+func runOnce(client *bigquery.Client, files []setup.File, vars map[string]string) (*prometheus.Registry, error) {
+	reg := prometheus.NewRegistry()
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	failed := []string{}
+	for i := range files {
+		wg.Add(1)
+		go func(f *setup.File) {
+			defer wg.Done()
+			err := runOnceFile(client, f, vars, reg)
+			if err != nil {
+				log.Println("Error:", f.Name, err)
+				mux.Lock()
+				failed = append(failed, f.Name)
+				mux.Unlock()
+			}
+		}(&files[i])
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return reg, fmt.Errorf("%d of %d queries failed: %v", len(failed), len(files), failed)
+	}
+	return reg, nil
+}
+
+// writeMetrics writes the metrics from g to w in the given format, either
+// "text" for the Prometheus exposition format or "json".
+func writeMetrics(w io.Writer, format string, g prometheus.Gatherer) error {
+	if format != formatText && format != formatJSON {
+		return fmt.Errorf("unknown output format %q", format)
+	}
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	if format == formatJSON {
+		return json.NewEncoder(w).Encode(familiesToSamples(mfs))
+	}
+	for _, mf := range mfs {
+		if _, err = expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runOnceFile runs the query for the given file and registers the results
+// with reg.
+func runOnceFile(client *bigquery.Client, f *setup.File, vars map[string]string, reg *prometheus.Registry) error {
+	release, err := limiter.Acquire(mainCtx, jobProject(f.Config))
+	if err != nil {
+		return err
+	}
+	defer release()
+	c, err := newFileCollector(client, f, vars)
+	if err != nil {
+		return err
+	}
+	err = c.Update()
+	if err != nil {
+		return err
+	}
+	// Registration reports the results of the Update above, without running
+	// the query again.
+	return reg.Register(c)
+}
+
+// familiesToSamples converts the gathered metric families to a flat list of
+// samples.
+func familiesToSamples(mfs []*dto.MetricFamily) []sample {
+	samples := []sample{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			s := sample{Name: mf.GetName(), Labels: map[string]string{}}
+			for _, l := range m.GetLabel() {
+				s.Labels[l.GetName()] = l.GetValue()
+			}
+			switch {
+			case m.Gauge != nil:
+				s.Value = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				s.Value = m.GetCounter().GetValue()
+			case m.Untyped != nil:
+				s.Value = m.GetUntyped().GetValue()
+			}
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/limit"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+// onceRunner fails for queries that contain "fail".
+type onceRunner struct{}
+
+func (r *onceRunner) Query(query string) ([]sql.Metric, error) {
+	if strings.Contains(query, "fail") {
+		return nil, fmt.Errorf("fake query error")
+	}
+	return []sql.Metric{
+		sql.NewMetric([]string{"site"}, []string{"lga01"}, map[string]float64{"": 1.5}),
+	}, nil
+}
+
+func Test_runOnce(t *testing.T) {
+	withFakeRunner(t, &onceRunner{})
+	dir := t.TempDir()
+	rtx.Must(ioutil.WriteFile(dir+"/once_ok.sql", []byte("SELECT ok"), 0644), "Failed to write file")
+	rtx.Must(ioutil.WriteFile(dir+"/once_fail.sql", []byte("SELECT fail"), 0644), "Failed to write file")
+
+	tests := []struct {
+		name    string
+		files   []string
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "text",
+			files:  []string{"once_ok.sql"},
+			format: formatText,
+			want:   "# HELP once_ok help text\n# TYPE once_ok gauge\nonce_ok{site=\"lga01\"} 1.5\n",
+		},
+		{
+			name:   "json",
+			files:  []string{"once_ok.sql"},
+			format: formatJSON,
+			want:   `[{"name":"once_ok","labels":{"site":"lga01"},"value":1.5}]` + "\n",
+		},
+		{
+			name:    "error-query",
+			files:   []string{"once_ok.sql", "once_fail.sql"},
+			format:  formatText,
+			want:    "# HELP once_ok help text\n# TYPE once_ok gauge\nonce_ok{site=\"lga01\"} 1.5\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-format",
+			files:   []string{"once_ok.sql"},
+			format:  "yaml",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := make([]setup.File, len(tt.files))
+			for i := range tt.files {
+				files[i].Name = dir + "/" + tt.files[i]
+			}
+			var b bytes.Buffer
+			reg, err := runOnce(nil, files, map[string]string{})
+			if werr := writeMetrics(&b, tt.format, reg); err == nil {
+				err = werr
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runOnce() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if b.String() != tt.want {
+				t.Errorf("runOnce() = %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_runOnce_limitPerProject(t *testing.T) {
+	var running, max int64
+	withFakeRunner(t, &concurrentRunner{running: &running, max: &max})
+	origLimiter, origNewClient, origClients := limiter, newClient, clients
+	defer func() { limiter, newClient, clients = origLimiter, origNewClient, origClients }()
+	newClient = func(config.Client) (*bigquery.Client, error) {
+		return nil, nil
+	}
+	clients = map[config.Client]*bigquery.Client{}
+	limiter = limit.New(0, 1)
+
+	files := []setup.File{}
+	for _, p := range []string{"mlab-a", "mlab-a", "mlab-b", "mlab-b"} {
+		files = append(files, setup.File{Name: tempQueryFile(t), Config: config.Query{Project: p}})
+	}
+	if _, err := runOnce(nil, files, map[string]string{}); err != nil {
+		t.Fatalf("runOnce() error = %v", err)
+	}
+	// One query runs at a time in each project.
+	if max != 2 {
+		t.Errorf("runOnce() ran %d concurrent queries, want 2", max)
+	}
+}
+
+func Test_runOnce_bigqueryEndpoint(t *testing.T) {
+	// A stand-in for an emulator that serves the jobs.query and jobs.get
+	// APIs for the example query.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/projects/test-project/queries":
+			var req struct{ Query string }
+			rtx.Must(json.NewDecoder(r.Body).Decode(&req), "Failed to decode request")
+			if !strings.Contains(req.Query, "example_data") {
+				t.Errorf("query = %q, want the example query", req.Query)
+			}
+			fmt.Fprint(w, `{
+				"jobComplete": true,
+				"jobReference": {"projectId": "test-project", "jobId": "job1"},
+				"schema": {"fields": [{"name": "label", "type": "STRING"}, {"name": "value", "type": "INTEGER"}]},
+				"rows": [{"f": [{"v": "a"}, {"v": "5"}]}, {"f": [{"v": "b"}, {"v": "5"}]}],
+				"totalRows": "2"
+			}`)
+		case "/projects/test-project/jobs/job1":
+			fmt.Fprint(w, `{
+				"jobReference": {"projectId": "test-project", "jobId": "job1"},
+				"status": {"state": "DONE"},
+				"statistics": {"query": {"totalBytesBilled": "10485760"}}
+			}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	origEndpoint, origNoAuth, origCtx := *bqEndpoint, *noAuth, mainCtx
+	defer func() { *bqEndpoint, *noAuth, mainCtx = origEndpoint, origNoAuth, origCtx }()
+	*bqEndpoint = srv.URL
+	*noAuth = true
+	mainCtx = context.Background()
+
+	client, err := bigquery.NewClient(mainCtx, "test-project", bigqueryOptions()...)
+	rtx.Must(err, "Failed to create client")
+	defer client.Close()
+	files := []setup.File{{Name: "example/config/bq_example.sql"}}
+	reg, err := runOnce(client, files, map[string]string{})
+	if err != nil {
+		t.Fatalf("runOnce() error = %v", err)
+	}
+	var b bytes.Buffer
+	rtx.Must(writeMetrics(&b, formatText, reg), "Failed to write metrics")
+	want := "# HELP bq_example help text\n# TYPE bq_example gauge\n" +
+		"bq_example{label=\"a\"} 5\nbq_example{label=\"b\"} 5\n"
+	if b.String() != want {
+		t.Errorf("runOnce() = %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+const (
+	otlpHTTP = "http"
+	otlpGRPC = "grpc"
+
+	// otlpScope is the instrumentation scope of all exported metrics.
+	otlpScope = "github.com/m-lab/prometheus-bigquery-exporter"
+)
+
+// newOTLPExporter creates an OTLP metric exporter for the endpoint, given as
+// host:port, using the protocol otlpHTTP or otlpGRPC.
+func newOTLPExporter(ctx context.Context, protocol, endpoint string, insecure bool, headers map[string]string) (sdkmetric.Exporter, error) {
+	switch protocol {
+	case otlpHTTP:
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(endpoint),
+			otlpmetrichttp.WithHeaders(headers),
+		}
+		if insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	case otlpGRPC:
+		opts := []otlpmetricgrpc.Option{
+			otlpmetricgrpc.WithEndpoint(endpoint),
+			otlpmetricgrpc.WithHeaders(headers),
+		}
+		if insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	}
+	return nil, fmt.Errorf("unsupported OTLP protocol %q", protocol)
+}
+
+// otlpWriter exports the cached query metrics to an OTLP endpoint.
+type otlpWriter struct {
+	exporter sdkmetric.Exporter
+	// project is the project of queries without a project of their own.
+	project string
+	// start is the start time of cumulative sums and histograms.
+	start time.Time
+}
+
+// newOTLPWriter creates an otlpWriter for query metrics. Queries without a
+// project of their own belong to the given default project.
+func newOTLPWriter(exporter sdkmetric.Exporter, project string) *otlpWriter {
+	return &otlpWriter{exporter: exporter, project: project, start: time.Now()}
+}
+
+// write exports the current metrics of every file, with one resource per
+// file. Metrics are read from the collector cache, so no query is run. write
+// tries every file and returns the first error.
+func (w *otlpWriter) write(ctx context.Context, files []setup.File) error {
+	var first error
+	now := time.Now()
+	for i := range files {
+		mfs, err := files[i].Gather()
+		if err == nil && len(mfs) == 0 {
+			continue
+		}
+		if err == nil {
+			err = w.exporter.Export(ctx, w.resourceMetrics(&files[i], mfs, now))
+		}
+		if err != nil && first == nil {
+			first = fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+	}
+	return first
+}
+
+// resourceMetrics converts the metric families of the query file to OTLP
+// metrics of a resource with the project and query file attributes.
+func (w *otlpWriter) resourceMetrics(f *setup.File, mfs []*dto.MetricFamily, now time.Time) *metricdata.ResourceMetrics {
+	project := f.Config.Project
+	if project == "" {
+		project = w.project
+	}
+	return &metricdata.ResourceMetrics{
+		Resource: resource.NewSchemaless(
+			attribute.String("service.name", "bigquery_exporter"),
+			attribute.String("cloud.provider", "gcp"),
+			attribute.String("cloud.account.id", project),
+			attribute.String("bigquery.query.file", f.Name),
+		),
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Scope:   instrumentation.Scope{Name: otlpScope},
+			Metrics: familiesToOTLP(mfs, w.start, now),
+		}},
+	}
+}
+
+// familiesToOTLP converts Prometheus metric families to OTLP metrics. Gauges
+// and untyped metrics become gauges, counters become monotonic cumulative
+// sums, and histograms become cumulative histograms. Data points use the
+// metric timestamp, or now when the metric has none. Other types are skipped.
+func familiesToOTLP(mfs []*dto.MetricFamily, start, now time.Time) []metricdata.Metrics {
+	metrics := []metricdata.Metrics{}
+	for _, mf := range mfs {
+		m := metricdata.Metrics{Name: mf.GetName(), Description: mf.GetHelp()}
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			points := []metricdata.DataPoint[float64]{}
+			for _, pm := range mf.GetMetric() {
+				v := pm.GetGauge().GetValue()
+				if mf.GetType() == dto.MetricType_UNTYPED {
+					v = pm.GetUntyped().GetValue()
+				}
+				points = append(points, metricdata.DataPoint[float64]{
+					Attributes: labelsToSet(pm.GetLabel()),
+					Time:       metricTime(pm, now),
+					Value:      v,
+				})
+			}
+			m.Data = metricdata.Gauge[float64]{DataPoints: points}
+		case dto.MetricType_COUNTER:
+			points := []metricdata.DataPoint[float64]{}
+			for _, pm := range mf.GetMetric() {
+				points = append(points, metricdata.DataPoint[float64]{
+					Attributes: labelsToSet(pm.GetLabel()),
+					StartTime:  start,
+					Time:       metricTime(pm, now),
+					Value:      pm.GetCounter().GetValue(),
+				})
+			}
+			m.Data = metricdata.Sum[float64]{
+				DataPoints:  points,
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+			}
+		case dto.MetricType_HISTOGRAM:
+			points := []metricdata.HistogramDataPoint[float64]{}
+			for _, pm := range mf.GetMetric() {
+				points = append(points, histogramPoint(pm, start, now))
+			}
+			m.Data = metricdata.Histogram[float64]{
+				DataPoints:  points,
+				Temporality: metricdata.CumulativeTemporality,
+			}
+		default:
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// histogramPoint converts the cumulative buckets of a Prometheus histogram to
+// the per-bucket counts of an OTLP histogram data point.
+func histogramPoint(pm *dto.Metric, start, now time.Time) metricdata.HistogramDataPoint[float64] {
+	h := pm.GetHistogram()
+	p := metricdata.HistogramDataPoint[float64]{
+		Attributes: labelsToSet(pm.GetLabel()),
+		StartTime:  start,
+		Time:       metricTime(pm, now),
+		Count:      h.GetSampleCount(),
+		Sum:        h.GetSampleSum(),
+	}
+	var prev uint64
+	for _, b := range h.GetBucket() {
+		p.Bounds = append(p.Bounds, b.GetUpperBound())
+		p.BucketCounts = append(p.BucketCounts, b.GetCumulativeCount()-prev)
+		prev = b.GetCumulativeCount()
+	}
+	// The last bucket counts the observations above the largest bound.
+	p.BucketCounts = append(p.BucketCounts, h.GetSampleCount()-prev)
+	return p
+}
+
+// labelsToSet converts Prometheus labels to OTLP attributes.
+func labelsToSet(labels []*dto.LabelPair) attribute.Set {
+	kvs := make([]attribute.KeyValue, 0, len(labels))
+	for _, l := range labels {
+		kvs = append(kvs, attribute.String(l.GetName(), l.GetValue()))
+	}
+	return attribute.NewSet(kvs...)
+}
+
+// metricTime returns the timestamp of pm, or now if pm has none.
+func metricTime(pm *dto.Metric, now time.Time) time.Time {
+	if pm.TimestampMs == nil {
+		return now
+	}
+	return time.UnixMilli(pm.GetTimestampMs()).UTC()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func Test_familiesToOTLP(t *testing.T) {
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(time.Hour)
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "g", Help: "gauge"}, []string{"site"})
+	g.WithLabelValues("lga01").Set(1.5)
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "c", Help: "counter"})
+	c.Add(3)
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "h", Help: "histogram", Buckets: []float64{1, 10}})
+	h.Observe(0.5)
+	h.Observe(5)
+	h.Observe(50)
+	reg.MustRegister(g, c, h)
+	mfs, err := reg.Gather()
+	rtx.Must(err, "Failed to gather")
+	// Metric timestamps are used instead of now.
+	mfs[2].Metric[0].TimestampMs = proto.Int64(start.UnixMilli())
+
+	got := familiesToOTLP(mfs, start, now)
+	want := []metricdata.Metrics{
+		{
+			Name: "c", Description: "counter",
+			Data: metricdata.Sum[float64]{
+				DataPoints:  []metricdata.DataPoint[float64]{{Attributes: attribute.NewSet(), StartTime: start, Time: now, Value: 3}},
+				Temporality: metricdata.CumulativeTemporality,
+				IsMonotonic: true,
+			},
+		},
+		{
+			Name: "g", Description: "gauge",
+			Data: metricdata.Gauge[float64]{
+				DataPoints: []metricdata.DataPoint[float64]{{Attributes: attribute.NewSet(attribute.String("site", "lga01")), Time: now, Value: 1.5}},
+			},
+		},
+		{
+			Name: "h", Description: "histogram",
+			Data: metricdata.Histogram[float64]{
+				DataPoints: []metricdata.HistogramDataPoint[float64]{{
+					Attributes:   attribute.NewSet(),
+					StartTime:    start,
+					Time:         start,
+					Count:        3,
+					Sum:          55.5,
+					Bounds:       []float64{1, 10},
+					BucketCounts: []uint64{1, 1, 1},
+				}},
+				Temporality: metricdata.CumulativeTemporality,
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("familiesToOTLP() = %#v, want %#v", got, want)
+	}
+	// Summaries are not supported.
+	if got := familiesToOTLP([]*dto.MetricFamily{{Type: dto.MetricType_SUMMARY.Enum()}}, start, now); len(got) != 0 {
+		t.Errorf("familiesToOTLP() = %#v, want no metrics", got)
+	}
+}
+
+func Test_otlpWriter_write(t *testing.T) {
+	code := http.StatusOK
+	// A mock collector records the resources of the metrics it receives.
+	resources := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		r := &colmetricpb.ExportMetricsServiceRequest{}
+		rtx.Must(proto.Unmarshal(b, r), "Failed to decode request")
+		for _, rm := range r.ResourceMetrics {
+			attrs := []string{}
+			for _, kv := range rm.Resource.Attributes {
+				attrs = append(attrs, kv.Key+"="+kv.Value.GetStringValue())
+			}
+			for _, m := range rm.ScopeMetrics[0].Metrics {
+				attrs = append(attrs, m.Name)
+			}
+			resources = append(resources, strings.Join(attrs, ","))
+		}
+		rw.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	files := []setup.File{
+		{Name: "otlp_a.sql"},
+		{Name: "otlp_b.sql"},
+		{Name: "otlp_c.sql", Config: config.Query{Project: "measurement-lab"}},
+	}
+	for _, i := range []int{0, 2} {
+		c := sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, fileToMetric(files[i].Name), "", nil)
+		rtx.Must(c.Update(), "Failed to update collector")
+		rtx.Must(files[i].Register(c), "Failed to register collector")
+		defer prometheus.Unregister(c)
+	}
+
+	endpoint := strings.TrimPrefix(srv.URL, "http://")
+	exp, err := newOTLPExporter(context.Background(), otlpHTTP, endpoint, true, nil)
+	rtx.Must(err, "Failed to create exporter")
+	w := newOTLPWriter(exp, "mlab-sandbox")
+	if err := w.write(context.Background(), files); err != nil {
+		t.Errorf("otlpWriter.write() error = %v", err)
+	}
+	// Only the files with results are exported, with the project of the query.
+	want := []string{
+		"bigquery.query.file=otlp_a.sql,cloud.account.id=mlab-sandbox,cloud.provider=gcp,service.name=bigquery_exporter,otlp_aokay",
+		"bigquery.query.file=otlp_c.sql,cloud.account.id=measurement-lab,cloud.provider=gcp,service.name=bigquery_exporter,otlp_cokay",
+	}
+	if !reflect.DeepEqual(resources, want) {
+		t.Errorf("otlpWriter.write() resources = %v, want %v", resources, want)
+	}
+	code = http.StatusBadRequest
+	if err := w.write(context.Background(), files); err == nil {
+		t.Errorf("otlpWriter.write() expected error")
+	}
+	if _, err := newOTLPExporter(context.Background(), "udp", endpoint, true, nil); err == nil {
+		t.Errorf("newOTLPExporter() expected error")
+	}
+	if _, err := newOTLPExporter(context.Background(), otlpGRPC, endpoint, true, nil); err != nil {
+		t.Errorf("newOTLPExporter() error = %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushMetrics pushes the metrics from g to the Pushgateway at url, using the
+// given job name and grouping labels. The pushed metrics replace all metrics
+// previously pushed with the same job and grouping labels.
+func pushMetrics(url, job string, grouping map[string]string, g prometheus.Gatherer) error {
+	p := push.New(url, job).Gatherer(g)
+	for k, v := range grouping {
+		p = p.Grouping(k, v)
+	}
+	return p.Push()
+}
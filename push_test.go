@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_pushMetrics(t *testing.T) {
+	var method, path, body string
+	// A stand-in for the Pushgateway records the last request.
+	gw := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		method, path, body = req.Method, req.URL.Path, string(b)
+		if strings.Contains(path, "fail") {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer gw.Close()
+
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "push_metric", Help: "help text"})
+	g.Set(1.5)
+	reg.MustRegister(g)
+
+	err := pushMetrics(gw.URL, "bigquery_exporter", map[string]string{"env": "prod"}, reg)
+	if err != nil {
+		t.Fatalf("pushMetrics() error = %v", err)
+	}
+	if method != http.MethodPut {
+		t.Errorf("pushMetrics() method = %q, want %q", method, http.MethodPut)
+	}
+	if want := "/metrics/job/bigquery_exporter/env/prod"; path != want {
+		t.Errorf("pushMetrics() path = %q, want %q", path, want)
+	}
+	// The body is protobuf encoded, but includes the metric name.
+	if !strings.Contains(body, "push_metric") {
+		t.Errorf("pushMetrics() body does not contain push_metric")
+	}
+
+	err = pushMetrics(gw.URL, "fail", nil, reg)
+	if err == nil {
+		t.Errorf("pushMetrics() expected error from the Pushgateway")
+	}
+}
@@ -8,8 +8,11 @@ import (
 	"math"
 	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
 	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
 	"google.golang.org/api/iterator"
@@ -17,35 +20,78 @@ import (
 
 type bigQueryImpl struct {
 	bqiface.Client
+	// project is the default project of table names without a project, or
+	// empty for the client project.
+	project string
+	// bytesBilled is the number of bytes billed for the most recent query.
+	bytesBilled atomic.Int64
 }
 
-func (b *bigQueryImpl) Query(query string, visit func(row map[string]bigquery.Value) error) error {
+// sourceJob is implemented by row iterators that are backed by a query job,
+// such as the bqiface adapter for *bigquery.RowIterator.
+type sourceJob interface {
+	SourceJob() *bigquery.Job
+}
+
+func (b *bigQueryImpl) Query(query string, visit func(schema bigquery.Schema, row map[string]bigquery.Value) error) (bigquery.Schema, error) {
 	q := b.Client.Query(query)
+	if b.project != "" {
+		q.SetQueryConfig(bqiface.QueryConfig{
+			QueryConfig: bigquery.QueryConfig{Q: query, DefaultProjectID: b.project},
+		})
+	}
 	it, err := q.Read(context.Background())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var row map[string]bigquery.Value
 	for err = it.Next(&row); err == nil; err = it.Next(&row) {
-		err2 := visit(row)
+		err2 := visit(it.Schema(), row)
 		if err2 != nil {
-			return err2
+			return nil, err2
 		}
 	}
 	if err != iterator.Done {
-		return err
+		return nil, err
+	}
+	b.bytesBilled.Store(jobBytesBilled(it))
+	// The schema is available after the first call to Next, even when the
+	// query returns no rows.
+	return it.Schema(), nil
+}
+
+// jobBytesBilled returns the bytes billed by the query job of the given row
+// iterator, or zero if unknown.
+func jobBytesBilled(it bqiface.RowIterator) int64 {
+	sj, ok := it.(sourceJob)
+	if !ok {
+		return 0
+	}
+	j := sj.SourceJob()
+	if j == nil {
+		return 0
 	}
-	return nil
+	status, err := j.Status(context.Background())
+	if err != nil || status.Statistics == nil {
+		return 0
+	}
+	if qs, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		return qs.TotalBytesBilled
+	}
+	return 0
 }
 
 // BQRunner is a concerete implementation of QueryRunner for BigQuery.
 type BQRunner struct {
 	runner runner
+	// counter is true if the query reports counters, with optional exemplars.
+	counter bool
 }
 
-// runner interface allows unit testing of the Query function.
+// runner interface allows unit testing of the Query function. The rows are
+// visited with the result schema.
 type runner interface {
-	Query(q string, visit func(row map[string]bigquery.Value) error) error
+	Query(q string, visit func(schema bigquery.Schema, row map[string]bigquery.Value) error) (bigquery.Schema, error)
 }
 
 // NewBQRunner creates a new QueryRunner instance.
@@ -57,19 +103,56 @@ func NewBQRunner(client *bigquery.Client) *BQRunner {
 	}
 }
 
+// SetProject sets the default project of table names without a project in
+// queries, instead of the client project that runs the queries.
+func (qr *BQRunner) SetProject(project string) {
+	if b, ok := qr.runner.(*bigQueryImpl); ok {
+		b.project = project
+	}
+}
+
+// SetCounter configures whether the query reports counters. Only counter
+// queries report exemplar columns. In other queries, they are labels.
+func (qr *BQRunner) SetCounter(counter bool) {
+	qr.counter = counter
+}
+
 // Query executes the given query. Query only supports standard SQL. The
 // query must define a column named "value" for the value, and may define
 // additional columns, all of which are used as metric labels.
 func (qr *BQRunner) Query(query string) ([]sql.Metric, error) {
+	metrics, _, err := qr.QuerySchema(query)
+	return metrics, err
+}
+
+// QuerySchema executes the given query like Query, and also returns the
+// schema of the query result. The schema is derived from the result columns,
+// so it is available even when the query returns no rows.
+func (qr *BQRunner) QuerySchema(query string) ([]sql.Metric, *sql.Schema, error) {
+	return querySchema(qr.runner, query, qr.counter)
+}
+
+// querySchema executes the given query with r, and converts every row to a
+// metric and the result schema to a sql.Schema. Exemplar columns are only
+// reported by counter queries.
+func querySchema(r runner, query string, counter bool) ([]sql.Metric, *sql.Schema, error) {
 	metrics := []sql.Metric{}
-	err := qr.runner.Query(query, func(row map[string]bigquery.Value) error {
-		metrics = append(metrics, rowToMetric(row))
+	schema, err := r.Query(query, func(schema bigquery.Schema, row map[string]bigquery.Value) error {
+		metrics = append(metrics, rowToMetric(row, specialColumns(schema, counter)))
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	return metrics, schemaToSchema(schema, counter), nil
+}
+
+// LastStats returns the statistics of the most recent query.
+func (qr *BQRunner) LastStats() sql.Stats {
+	if b, ok := qr.runner.(*bigQueryImpl); ok {
+		return sql.Stats{BytesBilled: b.bytesBilled.Load()}
 	}
-	return metrics, nil
+	return sql.Stats{}
 }
 
 // valToFloat extracts a float from the bigquery.Value irrespective of the
@@ -100,15 +183,116 @@ func valToString(v bigquery.Value) string {
 	return s
 }
 
-// rowToMetric converts a bigquery result row to a bq.Metric
-func rowToMetric(row map[string]bigquery.Value) sql.Metric {
+// timestampColumn is the name of the optional column with the time of the
+// values in every row, and createdColumn is the name of the optional column
+// with the time counter values started to accumulate. Only columns with a
+// TIMESTAMP, DATETIME, or DATE type are times, and NULL values are ignored.
+// Columns with the same names and other types are labels.
+const (
+	timestampColumn = "timestamp"
+	createdColumn   = "created"
+)
+
+// exemplarPrefix starts the names of optional exemplar columns of counter
+// queries. The rest of the column name is the exemplar label name, e.g.
+// "exemplar_trace_id" is the "trace_id" label of the exemplar.
+const exemplarPrefix = "exemplar_"
+
+// isTimeField reports whether field has a TIMESTAMP, DATETIME, or DATE type.
+func isTimeField(field *bigquery.FieldSchema) bool {
+	switch field.Type {
+	case bigquery.TimestampFieldType, bigquery.DateTimeFieldType, bigquery.DateFieldType:
+		return true
+	}
+	return false
+}
+
+// specialColumns returns the names of the columns in schema that are neither
+// labels nor values: the timestamp and created columns with a time type, and
+// the exemplar columns of counter queries.
+func specialColumns(schema bigquery.Schema, counter bool) map[string]bool {
+	special := map[string]bool{}
+	for _, field := range schema {
+		switch {
+		case (field.Name == timestampColumn || field.Name == createdColumn) && isTimeField(field):
+			special[field.Name] = true
+		case counter && strings.HasPrefix(field.Name, exemplarPrefix):
+			special[field.Name] = true
+		}
+	}
+	return special
+}
+
+// valToTime converts a TIMESTAMP, DATETIME, or DATE value to a time.
+// DATETIME and DATE values are interpreted as UTC. valToTime reports false
+// for any other type.
+func valToTime(v bigquery.Value) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case civil.DateTime:
+		return t.In(time.UTC), true
+	case civil.Date:
+		return t.In(time.UTC), true
+	}
+	return time.Time{}, false
+}
+
+// schemaToSchema converts a bigquery result schema to a sql.Schema using the
+// same column conventions as rowToMetric. If the schema is empty, then
+// schemaToSchema returns nil.
+func schemaToSchema(schema bigquery.Schema, counter bool) *sql.Schema {
+	if len(schema) == 0 {
+		return nil
+	}
+	special := specialColumns(schema, counter)
+	s := &sql.Schema{}
+	for _, field := range schema {
+		if special[field.Name] {
+			continue
+		}
+		if strings.HasPrefix(field.Name, "value") {
+			s.ValueKeys = append(s.ValueKeys, field.Name[5:])
+		} else {
+			s.LabelKeys = append(s.LabelKeys, field.Name)
+		}
+	}
+	sort.Strings(s.LabelKeys)
+	sort.Strings(s.ValueKeys)
+	return s
+}
+
+// rowToMetric converts a bigquery result row to a bq.Metric. The special
+// columns, as returned by specialColumns, are never labels, so that every row
+// has the labels of the schema.
+func rowToMetric(row map[string]bigquery.Value, special map[string]bool) sql.Metric {
 	values := make(map[string]float64, 1)
 	var labelKeys []string
 	var labelValues []string
+	var timestamp, created time.Time
+	var exemplar map[string]string
 
 	// Note that `range` does not guarantee map key order. So, we extract label
 	// names, sort them, and then extract values.
 	for k, v := range row {
+		if special[k] {
+			switch k {
+			case timestampColumn:
+				// NULL times are left zero.
+				timestamp, _ = valToTime(v)
+			case createdColumn:
+				created, _ = valToTime(v)
+			default:
+				// NULL exemplar values are ignored.
+				if v != nil {
+					if exemplar == nil {
+						exemplar = map[string]string{}
+					}
+					exemplar[k[len(exemplarPrefix):]] = valToString(v)
+				}
+			}
+			continue
+		}
 		if strings.HasPrefix(k, "value") {
 			// Get the value suffix used to augment the metric name. If k is
 			// "value", then the default name will just be the empty string.
@@ -122,5 +306,9 @@ func rowToMetric(row map[string]bigquery.Value) sql.Metric {
 	for i := range labelKeys {
 		labelValues = append(labelValues, valToString(row[labelKeys[i]]))
 	}
-	return sql.NewMetric(labelKeys, labelValues, values)
+	m := sql.NewMetric(labelKeys, labelValues, values)
+	m.Timestamp = timestamp
+	m.Created = created
+	m.Exemplar = exemplar
+	return m
 }
@@ -1,13 +1,19 @@
 package query
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"reflect"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
 	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/m-lab/go/cloud/bqfake"
 )
@@ -16,6 +22,8 @@ func TestRowToMetric(t *testing.T) {
 	tests := []struct {
 		name    string
 		row     map[string]bigquery.Value
+		schema  bigquery.Schema
+		counter bool
 		metric  sql.Metric
 		wantNaN bool
 	}{
@@ -77,6 +85,100 @@ func TestRowToMetric(t *testing.T) {
 				Values:      map[string]float64{"": 2.1},
 			},
 		},
+		{
+			name: "Timestamp column",
+			row: map[string]bigquery.Value{
+				"timestamp": civil.Date{Year: 2020, Month: 3, Day: 1},
+				"value":     2.1,
+			},
+			schema: bigquery.Schema{{Name: "timestamp", Type: bigquery.DateFieldType}},
+			metric: sql.Metric{
+				Values:    map[string]float64{"": 2.1},
+				Timestamp: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "Created and exemplar columns",
+			row: map[string]bigquery.Value{
+				"created":           time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+				"exemplar_trace_id": "abc123",
+				"exemplar_job_id":   nil,
+				"value":             2.1,
+			},
+			schema: bigquery.Schema{
+				{Name: "created", Type: bigquery.TimestampFieldType},
+				{Name: "exemplar_trace_id", Type: bigquery.StringFieldType},
+				{Name: "exemplar_job_id", Type: bigquery.StringFieldType},
+			},
+			counter: true,
+			metric: sql.Metric{
+				Values:   map[string]float64{"": 2.1},
+				Created:  time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+				Exemplar: map[string]string{"trace_id": "abc123"},
+			},
+		},
+		{
+			name: "Exemplar columns of gauges are labels",
+			row: map[string]bigquery.Value{
+				"exemplar_trace_id": "abc123",
+				"value":             2.1,
+			},
+			schema: bigquery.Schema{{Name: "exemplar_trace_id", Type: bigquery.StringFieldType}},
+			metric: sql.Metric{
+				LabelKeys:   []string{"exemplar_trace_id"},
+				LabelValues: []string{"abc123"},
+				Values:      map[string]float64{"": 2.1},
+			},
+		},
+		{
+			name: "NULL timestamp column is ignored",
+			row: map[string]bigquery.Value{
+				"timestamp": nil,
+				"value":     2.1,
+			},
+			schema: bigquery.Schema{{Name: "timestamp", Type: bigquery.TimestampFieldType}},
+			metric: sql.Metric{
+				Values: map[string]float64{"": 2.1},
+			},
+		},
+		{
+			name: "NULL created column is ignored",
+			row: map[string]bigquery.Value{
+				"created": nil,
+				"value":   2.1,
+			},
+			schema: bigquery.Schema{{Name: "created", Type: bigquery.DateTimeFieldType}},
+			metric: sql.Metric{
+				Values: map[string]float64{"": 2.1},
+			},
+		},
+		{
+			name: "String timestamp column is a label",
+			row: map[string]bigquery.Value{
+				"timestamp": "yesterday",
+				"value":     2.1,
+			},
+			schema: bigquery.Schema{{Name: "timestamp", Type: bigquery.StringFieldType}},
+			metric: sql.Metric{
+				LabelKeys:   []string{"timestamp"},
+				LabelValues: []string{"yesterday"},
+				Values:      map[string]float64{"": 2.1},
+			},
+		},
+		{
+			name: "String created column is a label",
+			row: map[string]bigquery.Value{
+				"created": "yesterday",
+				"value":   2.1,
+			},
+			schema:  bigquery.Schema{{Name: "created", Type: bigquery.StringFieldType}},
+			counter: true,
+			metric: sql.Metric{
+				LabelKeys:   []string{"created"},
+				LabelValues: []string{"yesterday"},
+				Values:      map[string]float64{"": 2.1},
+			},
+		},
 		{
 			name: "NaN value",
 			row: map[string]bigquery.Value{
@@ -90,7 +192,7 @@ func TestRowToMetric(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		m := rowToMetric(test.row)
+		m := rowToMetric(test.row, specialColumns(test.schema, test.counter))
 		if !test.wantNaN && !reflect.DeepEqual(m, test.metric) {
 			t.Errorf("Failed to convert row to metric. want %#v; got %#v", test.metric, m)
 		}
@@ -101,21 +203,22 @@ func TestRowToMetric(t *testing.T) {
 }
 
 type fakeQuery struct {
-	err  error
-	rows []map[string]bigquery.Value
+	err    error
+	rows   []map[string]bigquery.Value
+	schema bigquery.Schema
 }
 
-func (f *fakeQuery) Query(q string, visit func(row map[string]bigquery.Value) error) error {
+func (f *fakeQuery) Query(q string, visit func(schema bigquery.Schema, row map[string]bigquery.Value) error) (bigquery.Schema, error) {
 	if f.err != nil {
-		return f.err
+		return nil, f.err
 	}
 	for i := range f.rows {
-		err := visit(f.rows[i])
+		err := visit(f.schema, f.rows[i])
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return f.schema, nil
 }
 
 func TestBQRunner_Query(t *testing.T) {
@@ -163,16 +266,195 @@ func TestBQRunner_Query(t *testing.T) {
 	}
 }
 
+func TestBQRunner_QuerySchema(t *testing.T) {
+	tests := []struct {
+		name       string
+		runner     runner
+		counter    bool
+		want       []sql.Metric
+		wantSchema *sql.Schema
+		wantErr    bool
+	}{
+		{
+			name: "okay-no-rows",
+			runner: &fakeQuery{
+				schema: bigquery.Schema{
+					{Name: "value_foo"}, {Name: "machine"}, {Name: "value"}, {Name: "site"},
+				},
+			},
+			want: []sql.Metric{},
+			wantSchema: &sql.Schema{
+				LabelKeys: []string{"machine", "site"},
+				ValueKeys: []string{"", "_foo"},
+			},
+		},
+		{
+			name: "okay-timestamp",
+			runner: &fakeQuery{
+				schema: bigquery.Schema{
+					{Name: "timestamp", Type: bigquery.TimestampFieldType}, {Name: "value"},
+				},
+			},
+			want:       []sql.Metric{},
+			wantSchema: &sql.Schema{ValueKeys: []string{""}},
+		},
+		{
+			name: "okay-created-exemplar",
+			runner: &fakeQuery{
+				schema: bigquery.Schema{
+					{Name: "created", Type: bigquery.TimestampFieldType}, {Name: "exemplar_trace_id", Type: bigquery.StringFieldType}, {Name: "value"},
+				},
+			},
+			counter:    true,
+			want:       []sql.Metric{},
+			wantSchema: &sql.Schema{ValueKeys: []string{""}},
+		},
+		{
+			name: "okay-gauge-exemplar",
+			runner: &fakeQuery{
+				schema: bigquery.Schema{
+					{Name: "exemplar_trace_id", Type: bigquery.StringFieldType}, {Name: "value"},
+				},
+			},
+			want:       []sql.Metric{},
+			wantSchema: &sql.Schema{LabelKeys: []string{"exemplar_trace_id"}, ValueKeys: []string{""}},
+		},
+		{
+			name: "okay-string-timestamp",
+			runner: &fakeQuery{
+				schema: bigquery.Schema{
+					{Name: "timestamp", Type: bigquery.StringFieldType}, {Name: "value"},
+				},
+			},
+			want:       []sql.Metric{},
+			wantSchema: &sql.Schema{LabelKeys: []string{"timestamp"}, ValueKeys: []string{""}},
+		},
+		{
+			name:   "okay-no-schema",
+			runner: &fakeQuery{},
+			want:   []sql.Metric{},
+		},
+		{
+			name: "query-error",
+			runner: &fakeQuery{
+				err: fmt.Errorf("Fake query error"),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qr := &BQRunner{
+				runner:  tt.runner,
+				counter: tt.counter,
+			}
+			got, schema, err := qr.QuerySchema("select * from `fake-table`")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("BQRunner.QuerySchema() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BQRunner.QuerySchema() = %#v, want %#v", got, tt.want)
+			}
+			if !reflect.DeepEqual(schema, tt.wantSchema) {
+				t.Errorf("BQRunner.QuerySchema() schema = %#v, want %#v", schema, tt.wantSchema)
+			}
+		})
+	}
+}
+
+func TestBQRunner_Collect(t *testing.T) {
+	// Rows with and without times must have the same labels, or Collect
+	// panics with inconsistent label cardinality.
+	ts := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	qr := &BQRunner{
+		runner: &fakeQuery{
+			rows: []map[string]bigquery.Value{
+				{"site": "lga01", "timestamp": ts, "created": ts, "value": 1.0},
+				{"site": "nuq01", "timestamp": nil, "created": nil, "value": 2.0},
+			},
+			schema: bigquery.Schema{
+				{Name: "site", Type: bigquery.StringFieldType},
+				{Name: "timestamp", Type: bigquery.TimestampFieldType},
+				{Name: "created", Type: bigquery.TimestampFieldType},
+				{Name: "value", Type: bigquery.FloatFieldType},
+			},
+		},
+	}
+	c := sql.NewCollector(qr, prometheus.GaugeValue, "ndt_tests", "select", nil)
+	if err := c.Update(); err != nil {
+		t.Fatalf("Collector.Update() error = %v", err)
+	}
+	if n := testutil.CollectAndCount(c); n != 2 {
+		t.Errorf("Collector.Collect() = %d metrics, want 2", n)
+	}
+}
+
 func TestNewBQRunner(t *testing.T) {
 	NewBQRunner(nil)
 }
 
+func TestBQRunner_SetProject(t *testing.T) {
+	client := &schemaClient{
+		Client: bqfake.NewQueryReadClient(bqfake.QueryConfig[map[string]bigquery.Value]{}),
+	}
+	qr := &BQRunner{runner: &bigQueryImpl{Client: client}}
+	if _, err := qr.Query("SELECT 1 AS value"); err != nil || len(client.configs) != 0 {
+		t.Fatalf("BQRunner.Query() = %v, %v; want no query config", client.configs, err)
+	}
+	qr.SetProject("measurement-lab")
+	if _, err := qr.Query("SELECT 2 AS value"); err != nil {
+		t.Fatalf("BQRunner.Query() error = %v", err)
+	}
+	want := []bigquery.QueryConfig{{Q: "SELECT 2 AS value", DefaultProjectID: "measurement-lab"}}
+	if len(client.configs) != 1 || !reflect.DeepEqual(client.configs[0].QueryConfig, want[0]) {
+		t.Errorf("BQRunner.Query() query config = %#v, want %#v", client.configs, want)
+	}
+}
+
+// schemaClient wraps a bqfake client to return row iterators that report an
+// empty schema, which the bqfake.RowIterator does not support, and records
+// the query configs.
+type schemaClient struct {
+	bqiface.Client
+	configs []bqiface.QueryConfig
+}
+
+func (c *schemaClient) Query(q string) bqiface.Query {
+	return &schemaQuery{Query: c.Client.Query(q), client: c}
+}
+
+type schemaQuery struct {
+	bqiface.Query
+	client *schemaClient
+}
+
+func (q *schemaQuery) SetQueryConfig(c bqiface.QueryConfig) {
+	q.client.configs = append(q.client.configs, c)
+}
+
+func (q *schemaQuery) Read(ctx context.Context) (bqiface.RowIterator, error) {
+	it, err := q.Query.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &schemaIterator{RowIterator: it}, nil
+}
+
+type schemaIterator struct {
+	bqiface.RowIterator
+}
+
+func (it *schemaIterator) Schema() bigquery.Schema {
+	return bigquery.Schema{}
+}
+
 func TestBigQueryImpl_Query(t *testing.T) {
 	tests := []struct {
 		name    string
 		config  bqfake.QueryConfig[map[string]bigquery.Value]
 		query   string
-		visit   func(row map[string]bigquery.Value) error
+		visit   func(schema bigquery.Schema, row map[string]bigquery.Value) error
 		wantErr bool
 	}{
 		{
@@ -182,7 +464,7 @@ func TestBigQueryImpl_Query(t *testing.T) {
 					Rows: []map[string]bigquery.Value{{"value": 1.234}},
 				},
 			},
-			visit: func(row map[string]bigquery.Value) error {
+			visit: func(schema bigquery.Schema, row map[string]bigquery.Value) error {
 				return nil
 			},
 		},
@@ -193,7 +475,7 @@ func TestBigQueryImpl_Query(t *testing.T) {
 					Rows: []map[string]bigquery.Value{{"value": 1.234}},
 				},
 			},
-			visit: func(row map[string]bigquery.Value) error {
+			visit: func(schema bigquery.Schema, row map[string]bigquery.Value) error {
 				return fmt.Errorf("Fake visit error")
 			},
 			wantErr: true,
@@ -217,13 +499,32 @@ func TestBigQueryImpl_Query(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			client := bqfake.NewQueryReadClient(tt.config)
+			client := &schemaClient{
+				Client: bqfake.NewQueryReadClient(tt.config),
+			}
 			b := &bigQueryImpl{
 				Client: client,
 			}
-			if err := b.Query(tt.query, tt.visit); (err != nil) != tt.wantErr {
+			if _, err := b.Query(tt.query, tt.visit); (err != nil) != tt.wantErr {
 				t.Errorf("bigQueryImpl.Query() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestBQRunner_LastStats(t *testing.T) {
+	qr := &BQRunner{runner: &fakeQuery{}}
+	if got := qr.LastStats(); got != (sql.Stats{}) {
+		t.Errorf("BQRunner.LastStats() = %#v, want zero", got)
+	}
+	b := &bigQueryImpl{}
+	b.bytesBilled.Store(10485760)
+	qr = &BQRunner{runner: b}
+	if got := qr.LastStats(); got.BytesBilled != 10485760 {
+		t.Errorf("BQRunner.LastStats() = %#v, want 10485760 bytes billed", got)
+	}
+	// Row iterators without a source job report zero bytes billed.
+	if got := jobBytesBilled(&schemaIterator{}); got != 0 {
+		t.Errorf("jobBytesBilled() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,121 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// DryRunColumns returns the names of the result columns of the given query.
+// DryRunColumns uses a BigQuery dry run, which validates the query without
+// running it or billing any bytes.
+func DryRunColumns(ctx context.Context, client *bigquery.Client, query string) ([]string, error) {
+	q := client.Query(query)
+	q.DryRun = true
+	job, err := q.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := job.LastStatus()
+	if status == nil || status.Statistics == nil {
+		return nil, fmt.Errorf("dry run returned no statistics")
+	}
+	qs, ok := status.Statistics.Details.(*bigquery.QueryStatistics)
+	if !ok {
+		return nil, fmt.Errorf("dry run returned no query statistics")
+	}
+	names := make([]string, len(qs.Schema))
+	for i, field := range qs.Schema {
+		names[i] = field.Name
+	}
+	return names, nil
+}
+
+var (
+	// literalRE matches string literals and comments, whichever comes first.
+	literalRE    = regexp.MustCompile(`(?s)'(?:\\.|[^'\\])*'|"(?:\\.|[^"\\])*"|--[^\n]*|#[^\n]*|/\*.*?\*/`)
+	selectListRE = regexp.MustCompile(`(?is)\bSELECT\s+(?:DISTINCT\s+|ALL\s+)?(.*?)(?:\bFROM\b|$)`)
+	aliasRE      = regexp.MustCompile("(?i)\\bAS\\s+`?(\\w+)`?$")
+	columnRE     = regexp.MustCompile("^`?[\\w.-]+`?$")
+	// implicitRE matches an expression followed by an alias without AS, e.g.
+	// "SUM(x) value".
+	implicitRE = regexp.MustCompile("[\\w)\\]`']\\s+`?(\\w+)`?$")
+	// starRE matches "*", "t.*", and "* EXCEPT (...)" or "* REPLACE (...)".
+	starRE = regexp.MustCompile(`^(?:[\w.` + "`" + `-]+\.)?\*`)
+)
+
+// keywords may end an unnamed expression, e.g. "x IS NULL", so they are never
+// implicit aliases.
+var keywords = map[string]bool{
+	"AND": true, "ASC": true, "DESC": true, "END": true, "FALSE": true,
+	"IN": true, "IS": true, "LIKE": true, "NOT": true, "NULL": true,
+	"OR": true, "TRUE": true,
+}
+
+// ParseColumns returns the names of the result columns of the given query,
+// using a simple local parse of the first SELECT list outside of any
+// parentheses. Columns are named by an alias, e.g. "x AS value" or
+// "SUM(x) value", or by a column reference, e.g. "t.value". ParseColumns also
+// reports whether every column was named. Unnamed expressions and "*" are
+// ignored, in which case ParseColumns returns fewer columns than the query
+// and complete is false.
+func ParseColumns(query string) (names []string, complete bool) {
+	// Remove string literals and comments, which may contain anything.
+	q := literalRE.ReplaceAllStringFunc(query, func(s string) string {
+		if s[0] == '\'' || s[0] == '"' {
+			return "''"
+		}
+		return " "
+	})
+	m := selectListRE.FindStringSubmatch(flatten(q))
+	if m == nil {
+		return nil, false
+	}
+	names = []string{}
+	complete = true
+	for _, item := range strings.Split(m[1], ",") {
+		item = strings.TrimSpace(item)
+		if starRE.MatchString(item) {
+			complete = false
+		} else if a := aliasRE.FindStringSubmatch(item); a != nil {
+			names = append(names, a[1])
+		} else if columnRE.MatchString(item) {
+			parts := strings.Split(strings.Trim(item, "`"), ".")
+			names = append(names, parts[len(parts)-1])
+		} else if a := implicitRE.FindStringSubmatch(item); a != nil && !keywords[strings.ToUpper(a[1])] {
+			names = append(names, a[1])
+		} else {
+			complete = false
+		}
+	}
+	return names, complete
+}
+
+// flatten removes the content of all parentheses from q, so that "f(a, b)"
+// becomes "f()".
+func flatten(q string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range q {
+		switch {
+		case r == '(':
+			if depth == 0 {
+				b.WriteRune(r)
+			}
+			depth++
+		case r == ')':
+			if depth > 0 {
+				depth--
+			}
+			if depth == 0 {
+				b.WriteRune(r)
+			}
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
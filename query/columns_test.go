@@ -0,0 +1,76 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseColumns(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		want         []string
+		wantComplete bool
+	}{
+		{
+			name:         "aliases",
+			query:        "SELECT site AS machine, COUNT(*) AS value FROM t GROUP BY site",
+			want:         []string{"machine", "value"},
+			wantComplete: true,
+		},
+		{
+			name:         "column-references",
+			query:        "SELECT t.site, `value_p50` FROM t",
+			want:         []string{"site", "value_p50"},
+			wantComplete: true,
+		},
+		{
+			name: "with-clause-and-comments",
+			query: `
+-- Count tests, FROM every site.
+WITH tests AS (
+  SELECT site, 1 AS value_ignored FROM t
+)
+SELECT DISTINCT
+  site, # The site's label.
+  APPROX_QUANTILES(x, 100)[OFFSET(50)] AS value_p50,
+  'a, b -- FROM c' AS label
+FROM tests`,
+			want:         []string{"site", "value_p50", "label"},
+			wantComplete: true,
+		},
+		{
+			name:         "implicit-aliases",
+			query:        "SELECT label, SUM(x) value, 'a' `site`, CASE WHEN x THEN 1 END value_case FROM t",
+			want:         []string{"label", "value", "site", "value_case"},
+			wantComplete: true,
+		},
+		{
+			name:  "keywords-are-not-aliases",
+			query: "SELECT x IS NULL, CASE WHEN x THEN 1 END FROM t",
+			want:  []string{},
+		},
+		{
+			name:  "qualified-star",
+			query: "SELECT t.* EXCEPT (x), 1 AS value FROM t",
+			want:  []string{"value"},
+		},
+		{
+			name:  "unnamed-and-star",
+			query: "SELECT *, 1 + 2 FROM t",
+			want:  []string{},
+		},
+		{
+			name:  "not-a-query",
+			query: "not a query",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, complete := ParseColumns(tt.query)
+			if !reflect.DeepEqual(got, tt.want) || complete != tt.wantComplete {
+				t.Errorf("ParseColumns() = %#v, %v, want %#v, %v", got, complete, tt.want, tt.wantComplete)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package query
+
+import (
+	"context"
+	dbsql "database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+// dbImpl runs queries with a database/sql driver. Rows are converted to the
+// same values as BigQuery rows, so that the column conventions of rowToMetric
+// apply to every database.
+type dbImpl struct {
+	db *dbsql.DB
+}
+
+func (d *dbImpl) Query(query string, visit func(schema bigquery.Schema, row map[string]bigquery.Value) error) (bigquery.Schema, error) {
+	rows, err := d.db.QueryContext(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	schema := columnTypesToSchema(types)
+	vals := make([]interface{}, len(types))
+	ptrs := make([]interface{}, len(types))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]bigquery.Value, len(types))
+		for i, field := range schema {
+			row[field.Name] = dbValue(field, vals[i])
+		}
+		if err := visit(schema, row); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// columnTypesToSchema converts the result columns of a database/sql query to
+// a bigquery schema. Only the column names and whether a column holds a date
+// or time are needed to interpret the results.
+func columnTypesToSchema(types []*dbsql.ColumnType) bigquery.Schema {
+	schema := make(bigquery.Schema, len(types))
+	for i, t := range types {
+		schema[i] = &bigquery.FieldSchema{Name: t.Name(), Type: bigquery.StringFieldType}
+		name := strings.ToUpper(t.DatabaseTypeName())
+		if strings.Contains(name, "DATE") || strings.HasPrefix(name, "TIMESTAMP") {
+			schema[i].Type = bigquery.TimestampFieldType
+		}
+	}
+	return schema
+}
+
+// timeLayouts are the layouts of date and time columns returned as text, e.g.
+// DATETIME columns from MySQL without parseTime=true. Times without a zone
+// are interpreted as UTC.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// dbValue converts a value scanned from the given column to the type of the
+// equivalent BigQuery value. Drivers return text, and numeric types like
+// DECIMAL, as bytes, so bytes become strings, strings in value columns become
+// numbers where possible, and strings in date or time columns become times
+// where possible. Booleans become 1 or 0.
+func dbValue(field *bigquery.FieldSchema, v interface{}) bigquery.Value {
+	switch t := v.(type) {
+	case []byte:
+		v = string(t)
+	case bool:
+		if t {
+			return int64(1)
+		}
+		return int64(0)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	switch {
+	case field.Type == bigquery.TimestampFieldType:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t
+			}
+		}
+	case strings.HasPrefix(field.Name, "value"):
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// DBRunner is an implementation of QueryRunner for any database with a
+// database/sql driver, e.g. Postgres or MySQL. Query results follow the same
+// column conventions as BQRunner.
+type DBRunner struct {
+	runner runner
+	// counter is true if the query reports counters, with optional exemplars.
+	counter bool
+}
+
+// NewDBRunner creates a new QueryRunner instance for the given database.
+func NewDBRunner(db *dbsql.DB) *DBRunner {
+	return &DBRunner{runner: &dbImpl{db: db}}
+}
+
+// SetCounter configures whether the query reports counters, like
+// BQRunner.SetCounter.
+func (qr *DBRunner) SetCounter(counter bool) {
+	qr.counter = counter
+}
+
+// Query executes the given query in the SQL dialect of the database.
+func (qr *DBRunner) Query(query string) ([]sql.Metric, error) {
+	metrics, _, err := qr.QuerySchema(query)
+	return metrics, err
+}
+
+// QuerySchema executes the given query like Query, and also returns the
+// schema of the query result.
+func (qr *DBRunner) QuerySchema(query string) ([]sql.Metric, *sql.Schema, error) {
+	return querySchema(qr.runner, query, qr.counter)
+}
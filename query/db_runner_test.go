@@ -0,0 +1,188 @@
+package query
+
+import (
+	"context"
+	dbsql "database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+// fakeResult is the result of a query to the fake driver.
+type fakeResult struct {
+	columns []string
+	types   []string
+	rows    [][]driver.Value
+}
+
+// fakeResults maps queries to the results returned by the fake driver.
+var fakeResults = map[string]fakeResult{
+	"select-rows": {
+		columns: []string{"site", "timestamp", "value", "value_up"},
+		types:   []string{"TEXT", "TIMESTAMPTZ", "NUMERIC", "BOOL"},
+		rows: [][]driver.Value{
+			{[]byte("lga01"), time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), []byte("1.5"), true},
+			{"nuq01", time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC), int64(2), false},
+		},
+	},
+	"select-datetime": {
+		columns: []string{"site", "timestamp", "created", "value"},
+		types:   []string{"VARCHAR", "DATETIME", "DATE", "BIGINT"},
+		rows: [][]driver.Value{
+			{[]byte("lga01"), []byte("2020-03-01 12:30:00"), []byte("2020-01-01"), int64(1)},
+			{[]byte("nuq01"), nil, nil, int64(2)},
+		},
+	},
+	"select-empty": {
+		columns: []string{"site", "created", "value"},
+		types:   []string{"VARCHAR", "DATETIME", "BIGINT"},
+	},
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{}, nil
+}
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepare is not supported")
+}
+
+func (fakeConn) Close() error {
+	return nil
+}
+
+func (fakeConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported")
+}
+
+func (fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	t, ok := fakeResults[query]
+	if !ok {
+		return nil, fmt.Errorf("unknown table for query %q", query)
+	}
+	return &fakeRows{table: t}, nil
+}
+
+type fakeRows struct {
+	table fakeResult
+	next  int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.table.columns
+}
+
+func (r *fakeRows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.table.types[i]
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.table.rows) {
+		return io.EOF
+	}
+	copy(dest, r.table.rows[r.next])
+	r.next++
+	return nil
+}
+
+func init() {
+	dbsql.Register("fakedb", fakeDriver{})
+}
+
+func TestDBRunner_QuerySchema(t *testing.T) {
+	db, err := dbsql.Open("fakedb", "")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer db.Close()
+	ts := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		query      string
+		want       []sql.Metric
+		wantSchema *sql.Schema
+		wantErr    bool
+	}{
+		{
+			name:  "okay",
+			query: "select-rows",
+			want: []sql.Metric{
+				{
+					LabelKeys:   []string{"site"},
+					LabelValues: []string{"lga01"},
+					Values:      map[string]float64{"": 1.5, "_up": 1},
+					Timestamp:   ts,
+				},
+				{
+					LabelKeys:   []string{"site"},
+					LabelValues: []string{"nuq01"},
+					Values:      map[string]float64{"": 2, "_up": 0},
+					Timestamp:   ts.AddDate(0, 0, 1),
+				},
+			},
+			wantSchema: &sql.Schema{LabelKeys: []string{"site"}, ValueKeys: []string{"", "_up"}},
+		},
+		{
+			name:  "okay-datetime-text",
+			query: "select-datetime",
+			want: []sql.Metric{
+				{
+					LabelKeys:   []string{"site"},
+					LabelValues: []string{"lga01"},
+					Values:      map[string]float64{"": 1},
+					Timestamp:   time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC),
+					Created:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+				},
+				{
+					LabelKeys:   []string{"site"},
+					LabelValues: []string{"nuq01"},
+					Values:      map[string]float64{"": 2},
+				},
+			},
+			wantSchema: &sql.Schema{LabelKeys: []string{"site"}, ValueKeys: []string{""}},
+		},
+		{
+			name:       "okay-no-rows",
+			query:      "select-empty",
+			want:       []sql.Metric{},
+			wantSchema: &sql.Schema{LabelKeys: []string{"site"}, ValueKeys: []string{""}},
+		},
+		{
+			name:    "query-error",
+			query:   "select-missing",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qr := NewDBRunner(db)
+			got, schema, err := qr.QuerySchema(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DBRunner.QuerySchema() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DBRunner.QuerySchema() = %#v, want %#v", got, tt.want)
+			}
+			if !reflect.DeepEqual(schema, tt.wantSchema) {
+				t.Errorf("DBRunner.QuerySchema() schema = %#v, want %#v", schema, tt.wantSchema)
+			}
+			if _, err := qr.Query(tt.query); (err != nil) != tt.wantErr {
+				t.Errorf("DBRunner.Query() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
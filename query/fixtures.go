@@ -0,0 +1,232 @@
+package query
+
+import (
+	dbsql "database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// The pure Go SQLite driver, since the exporter is built without cgo.
+	_ "modernc.org/sqlite"
+)
+
+// NewFixtureRunner creates a QueryRunner for an in-memory SQLite database
+// seeded with the given fixture files, as described by LoadFixtures. The
+// runner allows developing queries without access to BigQuery.
+func NewFixtureRunner(names ...string) (*DBRunner, error) {
+	db, err := OpenFixtures(names...)
+	if err != nil {
+		return nil, err
+	}
+	return NewDBRunner(db), nil
+}
+
+// OpenFixtures opens an in-memory SQLite database seeded with the given
+// fixture files, as described by LoadFixtures. Runners created for the
+// database with NewDBRunner share its tables.
+func OpenFixtures(names ...string) (*dbsql.DB, error) {
+	db, err := dbsql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// Every connection to ":memory:" opens a new, empty database, so all
+	// queries must use the same connection.
+	db.SetMaxOpenConns(1)
+	err = LoadFixtures(db, names...)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// LoadFixtures creates a table for every named CSV or JSON file, and inserts
+// the rows of the file. The table name is the file name without extension,
+// e.g. "measurement-lab.ndt.unified_downloads.csv" creates the table used by
+// queries of `measurement-lab.ndt.unified_downloads`. CSV files must start
+// with a header row. JSON files must contain an array of objects. Columns of
+// integers, numbers, or RFC 3339 times or dates have the INTEGER, REAL, or
+// TIMESTAMP type, and all other columns have the TEXT type. Empty CSV values
+// and JSON nulls are NULL.
+func LoadFixtures(db *dbsql.DB, names ...string) error {
+	for _, name := range names {
+		columns, rows, err := readFixture(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		table := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+		err = createTable(db, table, columns, rows)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// readFixture reads the column names and rows of the named fixture file.
+// Values are strings, or nil for NULL.
+func readFixture(name string) ([]string, [][]interface{}, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		records, err := csv.NewReader(f).ReadAll()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(records) == 0 {
+			return nil, nil, fmt.Errorf("missing header row")
+		}
+		rows := make([][]interface{}, 0, len(records)-1)
+		for _, record := range records[1:] {
+			row := make([]interface{}, len(record))
+			for i, v := range record {
+				if v != "" {
+					row[i] = v
+				}
+			}
+			rows = append(rows, row)
+		}
+		return records[0], rows, nil
+	case ".json":
+		d := json.NewDecoder(f)
+		d.UseNumber()
+		objects := []map[string]interface{}{}
+		if err := d.Decode(&objects); err != nil {
+			return nil, nil, err
+		}
+		seen := map[string]bool{}
+		columns := []string{}
+		for _, o := range objects {
+			for k := range o {
+				if !seen[k] {
+					seen[k] = true
+					columns = append(columns, k)
+				}
+			}
+		}
+		sort.Strings(columns)
+		rows := make([][]interface{}, 0, len(objects))
+		for _, o := range objects {
+			row := make([]interface{}, len(columns))
+			for i, k := range columns {
+				row[i] = jsonToString(o[k])
+			}
+			rows = append(rows, row)
+		}
+		return columns, rows, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported fixture type %q", filepath.Ext(name))
+}
+
+// jsonToString converts a decoded JSON value to a fixture value. Booleans
+// become 1 or 0, and nested arrays and objects are kept as JSON.
+func jsonToString(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		if t {
+			return "1"
+		}
+		return "0"
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// fixtureTypes lists the column types of fixture tables from the most to the
+// least specific, with a function that converts a value to the type.
+var fixtureTypes = []struct {
+	name    string
+	convert func(string) (interface{}, bool)
+}{
+	{"INTEGER", func(s string) (interface{}, bool) {
+		i, err := strconv.ParseInt(s, 10, 64)
+		return i, err == nil
+	}},
+	{"REAL", func(s string) (interface{}, bool) {
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil
+	}},
+	{"TIMESTAMP", func(s string) (interface{}, bool) {
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02"} {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.UTC(), true
+			}
+		}
+		return nil, false
+	}},
+	{"TEXT", func(s string) (interface{}, bool) {
+		return s, true
+	}},
+}
+
+// createTable creates the named table with the given columns, where the type
+// of every column is the most specific type of all its values, and inserts
+// the rows.
+func createTable(db *dbsql.DB, table string, columns []string, rows [][]interface{}) error {
+	defs := make([]string, len(columns))
+	types := make([]int, len(columns))
+	for i, c := range columns {
+		types[i] = columnType(rows, i)
+		defs[i] = quoteIdent(c) + " " + fixtureTypes[types[i]].name
+	}
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(table), strings.Join(defs, ", ")))
+	if err != nil {
+		return err
+	}
+	params := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	insert := fmt.Sprintf("INSERT INTO %s VALUES (%s)", quoteIdent(table), params)
+	for _, row := range rows {
+		args := make([]interface{}, len(row))
+		for i, v := range row {
+			if v != nil {
+				args[i], _ = fixtureTypes[types[i]].convert(v.(string))
+			}
+		}
+		if _, err := db.Exec(insert, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// columnType returns the index of the first fixture type that accepts every
+// value of the given column.
+func columnType(rows [][]interface{}, column int) int {
+	for t := range fixtureTypes {
+		ok := true
+		for _, row := range rows {
+			if row[column] != nil {
+				_, ok = fixtureTypes[t].convert(row[column].(string))
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return t
+		}
+	}
+	// Not reached, since TEXT accepts every value.
+	return len(fixtureTypes) - 1
+}
+
+// quoteIdent quotes an SQLite identifier, e.g. a table name with dots.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
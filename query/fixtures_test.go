@@ -0,0 +1,90 @@
+package query
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+func TestNewFixtureRunner(t *testing.T) {
+	qr, err := NewFixtureRunner("testdata/measurement-lab.ndt.unified_downloads.csv", "testdata/sites.json")
+	if err != nil {
+		t.Fatalf("NewFixtureRunner() error = %v", err)
+	}
+	day1 := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		query      string
+		want       []sql.Metric
+		wantSchema *sql.Schema
+	}{
+		{
+			name: "csv",
+			query: "SELECT country, COUNT(*) AS value, SUM(download_mbps) AS value_mbps " +
+				"FROM `measurement-lab.ndt.unified_downloads` GROUP BY country ORDER BY country",
+			want: []sql.Metric{
+				sql.NewMetric([]string{"country"}, []string{"DE"}, map[string]float64{"": 1, "_mbps": 30}),
+				sql.NewMetric([]string{"country"}, []string{"US"}, map[string]float64{"": 3, "_mbps": 71}),
+			},
+			wantSchema: &sql.Schema{LabelKeys: []string{"country"}, ValueKeys: []string{"", "_mbps"}},
+		},
+		{
+			name: "csv-timestamp",
+			query: "SELECT date AS timestamp, download_mbps AS value " +
+				"FROM `measurement-lab.ndt.unified_downloads` WHERE country = 'DE'",
+			want: []sql.Metric{
+				{Values: map[string]float64{"": 30}, Timestamp: day1},
+			},
+			wantSchema: &sql.Schema{ValueKeys: []string{""}},
+		},
+		{
+			name:  "json",
+			query: "SELECT site, COALESCE(machines, 0) AS value, up AS value_up FROM sites ORDER BY site",
+			want: []sql.Metric{
+				sql.NewMetric([]string{"site"}, []string{"lga01"}, map[string]float64{"": 4, "_up": 1}),
+				sql.NewMetric([]string{"site"}, []string{"nuq01"}, map[string]float64{"": 0, "_up": 0}),
+			},
+			wantSchema: &sql.Schema{LabelKeys: []string{"site"}, ValueKeys: []string{"", "_up"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, schema, err := qr.QuerySchema(tt.query)
+			if err != nil {
+				t.Fatalf("QuerySchema() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QuerySchema() = %#v, want %#v", got, tt.want)
+			}
+			if !reflect.DeepEqual(schema, tt.wantSchema) {
+				t.Errorf("QuerySchema() schema = %#v, want %#v", schema, tt.wantSchema)
+			}
+		})
+	}
+}
+
+func TestLoadFixtures_errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixtures")
+	rtx.Must(err, "Failed to create tempdir")
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"empty.csv":    "",
+		"ragged.csv":   "a,b\n1\n",
+		"object.json":  `{"a": 1}`,
+		"fixture.yaml": "a: 1",
+	}
+	for name, content := range files {
+		rtx.Must(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), "Failed to write fixture")
+	}
+	for _, name := range []string{"empty.csv", "ragged.csv", "object.json", "fixture.yaml", "missing.csv"} {
+		if _, err := NewFixtureRunner(filepath.Join(dir, name)); err == nil {
+			t.Errorf("NewFixtureRunner(%q) expected error", name)
+		}
+	}
+}
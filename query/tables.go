@@ -0,0 +1,90 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googleapis/google-cloud-go-testing/bigquery/bqiface"
+)
+
+// tableMetadata interface allows unit testing of the LastModified function.
+type tableMetadata interface {
+	Metadata(ctx context.Context, project, dataset, table string) (*bigquery.TableMetadata, error)
+}
+
+type bigQueryTables struct {
+	bqiface.Client
+}
+
+func (b *bigQueryTables) Metadata(ctx context.Context, project, dataset, table string) (*bigquery.TableMetadata, error) {
+	return b.Client.DatasetInProject(project, dataset).Table(table).Metadata(ctx)
+}
+
+// TableChecker reports when BigQuery tables were last modified.
+type TableChecker struct {
+	tables  tableMetadata
+	project string
+}
+
+// NewTableChecker creates a new TableChecker. Table names without a project
+// refer to tables in the client project.
+func NewTableChecker(client *bigquery.Client) *TableChecker {
+	tc := &TableChecker{
+		tables: &bigQueryTables{
+			Client: bqiface.AdaptClient(client),
+		},
+	}
+	if client != nil {
+		tc.project = client.Project()
+	}
+	return tc
+}
+
+// SetProject sets the project of table names without a project, instead of
+// the client project.
+func (tc *TableChecker) SetProject(project string) {
+	tc.project = project
+}
+
+// LastModified returns the most recent LastModifiedTime of the named tables.
+// Table names have the form "project.dataset.table", "project:dataset.table",
+// or "dataset.table".
+func (tc *TableChecker) LastModified(ctx context.Context, names []string) (time.Time, error) {
+	var last time.Time
+	for _, name := range names {
+		project, dataset, table, err := parseTable(name, tc.project)
+		if err != nil {
+			return time.Time{}, err
+		}
+		md, err := tc.tables.Metadata(ctx, project, dataset, table)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if md.LastModifiedTime.After(last) {
+			last = md.LastModifiedTime
+		}
+	}
+	return last, nil
+}
+
+// parseTable splits a table name into project, dataset, and table. If the
+// name does not include a project, then the default project is returned.
+func parseTable(name, project string) (string, string, string, error) {
+	fields := strings.Split(strings.Replace(name, ":", ".", 1), ".")
+	switch len(fields) {
+	case 2:
+		fields = append([]string{project}, fields...)
+	case 3:
+	default:
+		return "", "", "", fmt.Errorf("invalid table name %q", name)
+	}
+	for _, f := range fields {
+		if f == "" {
+			return "", "", "", fmt.Errorf("invalid table name %q", name)
+		}
+	}
+	return fields[0], fields[1], fields[2], nil
+}
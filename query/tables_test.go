@@ -0,0 +1,108 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+type fakeTables struct {
+	modified map[string]time.Time
+}
+
+func (f *fakeTables) Metadata(ctx context.Context, project, dataset, table string) (*bigquery.TableMetadata, error) {
+	t, ok := f.modified[project+"."+dataset+"."+table]
+	if !ok {
+		return nil, fmt.Errorf("Error 404: Not found: Table %s.%s.%s", project, dataset, table)
+	}
+	return &bigquery.TableMetadata{LastModifiedTime: t}, nil
+}
+
+func TestTableChecker_LastModified(t *testing.T) {
+	t1 := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2023, 4, 2, 0, 0, 0, 0, time.UTC)
+	tc := &TableChecker{
+		tables: &fakeTables{
+			modified: map[string]time.Time{
+				"mlab-sandbox.ndt.downloads":  t1,
+				"measurement-lab.ndt.uploads": t2,
+			},
+		},
+		project: "mlab-sandbox",
+	}
+	tests := []struct {
+		name    string
+		tables  []string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:   "default-project",
+			tables: []string{"ndt.downloads"},
+			want:   t1,
+		},
+		{
+			name:   "latest-of-many",
+			tables: []string{"mlab-sandbox:ndt.downloads", "measurement-lab.ndt.uploads"},
+			want:   t2,
+		},
+		{
+			name:    "error-not-found",
+			tables:  []string{"ndt.missing"},
+			wantErr: true,
+		},
+		{
+			name:    "error-invalid-name",
+			tables:  []string{"downloads"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tc.LastModified(context.Background(), tt.tables)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TableChecker.LastModified() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("TableChecker.LastModified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    [3]string
+		wantErr bool
+	}{
+		{name: "p.d.t", want: [3]string{"p", "d", "t"}},
+		{name: "p:d.t", want: [3]string{"p", "d", "t"}},
+		{name: "d.t", want: [3]string{"default", "d", "t"}},
+		{name: "t", wantErr: true},
+		{name: "p..t", wantErr: true},
+		{name: "a.b.c.d", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, d, tbl, err := parseTable(tt.name, "default")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTable() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && [3]string{p, d, tbl} != tt.want {
+				t.Errorf("parseTable() = %v, want %v", [3]string{p, d, tbl}, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTableChecker(t *testing.T) {
+	tc := NewTableChecker(nil)
+	tc.SetProject("measurement-lab")
+	if tc.project != "measurement-lab" {
+		t.Errorf("SetProject() project = %q, want measurement-lab", tc.project)
+	}
+}
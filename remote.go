@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/remotewrite"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+// remoteWriter sends new query results to a remote write endpoint.
+type remoteWriter struct {
+	client *remotewrite.Client
+	// sent is the update time of the last results sent for every file.
+	sent map[string]time.Time
+}
+
+// newRemoteWriter creates a remoteWriter for the given client.
+func newRemoteWriter(client *remotewrite.Client) *remoteWriter {
+	return &remoteWriter{client: client, sent: map[string]time.Time{}}
+}
+
+// write sends the results of every file that were updated since the last
+// successful write, one file at a time. If the results of a file cannot be
+// sent, they are sent again by the next write, unless the endpoint rejected
+// them as invalid with status 400, e.g. as out of order samples. Rejected
+// results are logged and not sent again. Other client errors, e.g. for a
+// missing authorization, are logged as configuration errors and the results
+// are sent again. write returns the first error for results that are sent
+// again.
+func (w *remoteWriter) write(ctx context.Context, files []setup.File) error {
+	var first error
+	for i := range files {
+		r := files[i].Results()
+		if r == nil || !r.Updated.After(w.sent[files[i].Name]) {
+			continue
+		}
+		err := w.client.Write(ctx, resultsToSeries(files[i].Config.Labels, r))
+		var se *remotewrite.StatusError
+		if errors.As(err, &se) && se.StatusCode == http.StatusBadRequest {
+			log.Println("Dropping rejected remote write results:", files[i].Name, err)
+		} else if err != nil {
+			if se != nil && !se.Retryable() {
+				log.Println("Remote write configuration error:", files[i].Name, err)
+			}
+			if first == nil {
+				first = fmt.Errorf("%s: %v", files[i].Name, err)
+			}
+			continue
+		}
+		w.sent[files[i].Name] = r.Updated
+	}
+	return first
+}
+
+// resultsToSeries converts query results to time series with one sample
+// each, with the metric names of r.Names and the same labels reported by the
+// collector. Values without a metric name are skipped. Samples use the
+// timestamp of the metric, or the start time of the query when the metric has
+// none. Series are sorted by time, so that the samples of every series are
+// sent in order.
+func resultsToSeries(constLabels map[string]string, r *sql.Results) []remotewrite.TimeSeries {
+	series := []remotewrite.TimeSeries{}
+	for _, m := range r.Metrics {
+		ts := m.Timestamp
+		if ts.IsZero() {
+			ts = r.Updated
+		}
+		labels := make([]remotewrite.Label, 0, len(m.LabelKeys)+len(constLabels)+1)
+		for i, k := range m.LabelKeys {
+			labels = append(labels, remotewrite.Label{Name: sql.SanitizeName(k), Value: m.LabelValues[i]})
+		}
+		for k, v := range constLabels {
+			labels = append(labels, remotewrite.Label{Name: k, Value: v})
+		}
+		for suffix, v := range m.Values {
+			name, ok := r.Names[suffix]
+			if !ok {
+				continue
+			}
+			l := append([]remotewrite.Label{{Name: "__name__", Value: name}}, labels...)
+			sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+			series = append(series, remotewrite.TimeSeries{
+				Labels:  l,
+				Samples: []remotewrite.Sample{{Value: v, Timestamp: ts}},
+			})
+		}
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		return series[i].Samples[0].Timestamp.Before(series[j].Samples[0].Timestamp)
+	})
+	return series
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/remotewrite"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_resultsToSeries(t *testing.T) {
+	day1 := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	updated := day1.AddDate(0, 0, 7)
+	m1 := sql.NewMetric([]string{"site-name"}, []string{"lga01"}, map[string]float64{"": 1})
+	m1.Timestamp = day1.AddDate(0, 0, 1)
+	m2 := sql.NewMetric([]string{"site-name"}, []string{"lga01"}, map[string]float64{"": 2})
+	m2.Timestamp = day1
+	m3 := sql.NewMetric([]string{"site-name"}, []string{"nuq01"}, map[string]float64{".p50": 3})
+	r := &sql.Results{
+		Metrics: []sql.Metric{m1, m2, m3},
+		Updated: updated,
+		Names:   map[string]string{"": "bq_tests", ".p50": "bq_tests_p50"},
+	}
+
+	got := resultsToSeries(map[string]string{"env": "prod"}, r)
+	labels := func(name, site string) []remotewrite.Label {
+		return []remotewrite.Label{{Name: "__name__", Value: name}, {Name: "env", Value: "prod"}, {Name: "site_name", Value: site}}
+	}
+	want := []remotewrite.TimeSeries{
+		{Labels: labels("bq_tests", "lga01"), Samples: []remotewrite.Sample{{Value: 2, Timestamp: day1}}},
+		{Labels: labels("bq_tests", "lga01"), Samples: []remotewrite.Sample{{Value: 1, Timestamp: day1.AddDate(0, 0, 1)}}},
+		{Labels: labels("bq_tests_p50", "nuq01"), Samples: []remotewrite.Sample{{Value: 3, Timestamp: updated}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resultsToSeries() = %#v, want %#v", got, want)
+	}
+}
+
+func Test_remoteWriter_write(t *testing.T) {
+	requests := 0
+	code := http.StatusOK
+	// A mock receiver counts the samples it receives.
+	samples := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		b, _ := ioutil.ReadAll(req.Body)
+		series, err := remotewrite.DecodeRequest(b)
+		rtx.Must(err, "Failed to decode request")
+		for _, ts := range series {
+			samples += len(ts.Samples)
+		}
+		rw.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	files := []setup.File{{Name: "remote_a.sql"}, {Name: "remote_b.sql"}}
+	c := sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, "remote_a", "", nil)
+	rtx.Must(files[0].Register(c), "Failed to register collector")
+	defer prometheus.Unregister(c)
+
+	rc := remotewrite.New(srv.URL)
+	rc.Retries = 0
+	w := newRemoteWriter(rc)
+
+	// The first write fails, so the results are sent again.
+	code = http.StatusInternalServerError
+	if err := w.write(context.Background(), files); err == nil {
+		t.Errorf("remoteWriter.write() expected error")
+	}
+	code = http.StatusOK
+	if err := w.write(context.Background(), files); err != nil {
+		t.Errorf("remoteWriter.write() error = %v", err)
+	}
+	// Unchanged results are not sent again.
+	if err := w.write(context.Background(), files); err != nil {
+		t.Errorf("remoteWriter.write() error = %v", err)
+	}
+	if requests != 2 || samples != 2 {
+		t.Errorf("remoteWriter.write() sent %d requests with %d samples, want 2 and 2", requests, samples)
+	}
+}
+
+func Test_remoteWriter_write_rejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		want    map[string]int
+		wantErr bool
+	}{
+		{
+			// The rejected results are not sent again.
+			name: "bad-request",
+			code: http.StatusBadRequest,
+			want: map[string]int{"remote_a": 1, "remote_b": 1},
+		},
+		{
+			// Results are kept after configuration errors.
+			name:    "unauthorized",
+			code:    http.StatusUnauthorized,
+			want:    map[string]int{"remote_a": 2, "remote_b": 1},
+			wantErr: true,
+		},
+		{
+			name:    "not-found",
+			code:    http.StatusNotFound,
+			want:    map[string]int{"remote_a": 2, "remote_b": 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A mock receiver rejects samples for remote_a.
+			received := map[string]int{}
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				b, _ := ioutil.ReadAll(req.Body)
+				series, err := remotewrite.DecodeRequest(b)
+				rtx.Must(err, "Failed to decode request")
+				name := strings.TrimSuffix(series[0].Labels[0].Value, "okay")
+				received[name]++
+				if name == "remote_a" {
+					http.Error(rw, "rejected", tt.code)
+				}
+			}))
+			defer srv.Close()
+
+			files := []setup.File{{Name: "remote_a.sql"}, {Name: "remote_b.sql"}}
+			for i, name := range []string{"remote_a", "remote_b"} {
+				c := sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, name, "", nil)
+				rtx.Must(files[i].Register(c), "Failed to register collector")
+				defer prometheus.Unregister(c)
+			}
+
+			rc := remotewrite.New(srv.URL)
+			rc.Retries = 0
+			w := newRemoteWriter(rc)
+			// The rejected results do not prevent sending the results of
+			// other files.
+			for i := 0; i < 2; i++ {
+				if err := w.write(context.Background(), files); (err != nil) != tt.wantErr {
+					t.Errorf("remoteWriter.write() error = %v, wantErr %t", err, tt.wantErr)
+				}
+			}
+			if !reflect.DeepEqual(received, tt.want) {
+				t.Errorf("remoteWriter.write() sent %v, want %v", received, tt.want)
+			}
+		})
+	}
+}
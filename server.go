@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	_ "net/http/pprof" // Register the pprof handlers.
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/go/httpx"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/watchdog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+// updateFunc runs the given files according to mode and returns the files
+// that ran.
+type updateFunc func(files []setup.File, mode updateMode) []*setup.File
+
+// mustServe starts an http server on addr with handlers for prometheus
+// metrics, pprof, and the exporter status of the given files. When adminToken
+// is not empty, the admin handlers use update to run files on demand.
+func mustServe(addr string, files []setup.File, adminToken string, update updateFunc) *http.Server {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: newServeMux(files, adminToken, update),
+	}
+	rtx.Must(httpx.ListenAndServeAsync(srv), "Could not start metric server")
+	return srv
+}
+
+// newServeMux creates the handlers for the exporter http server. The admin
+// handlers are only created when adminToken is not empty.
+func newServeMux(files []setup.File, adminToken string, update updateFunc) *http.ServeMux {
+	mux := http.NewServeMux()
+	// The pprof handlers are registered with the default mux by net/http/pprof.
+	mux.Handle("/debug/pprof/", http.DefaultServeMux)
+	// Unlike the /metrics handler of prometheusx, metricsHandler serves
+	// OpenMetrics with units, so the exporter uses its own mux.
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer, metricsHandler(setup.WithUnits(prometheus.DefaultGatherer, files))))
+	mux.Handle("/ready", readyHandler(files))
+	mux.Handle("/readyz", readyHandler(files))
+	mux.Handle("/healthz", healthzHandler(loopWatchdog))
+	mux.Handle("/status", statusHandler(files))
+	if adminToken != "" {
+		mux.Handle("/-/refresh", adminAuth(adminToken, refreshHandler(files, update)))
+		mux.Handle("/-/reload", adminAuth(adminToken, reloadHandler(files, update)))
+	}
+	return mux
+}
+
+// metricsHandler serves the metrics from g in the format negotiated with the
+// scraper, compressed with gzip when accepted. Unlike the promhttp handler, the
+// OpenMetrics format includes metric units and the created timestamps of
+// counters. Like the promhttp handler with ContinueOnError, gather errors are
+// logged and the gathered metrics are served anyway.
+func metricsHandler(g prometheus.Gatherer) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		mfs, err := g.Gather()
+		if err != nil {
+			log.Println("Failed to gather metrics:", err)
+			if len(mfs) == 0 {
+				http.Error(rw, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		format := expfmt.NegotiateIncludingOpenMetrics(req.Header)
+		rw.Header().Set("Content-Type", string(format))
+		var w io.Writer = rw
+		if acceptsGzip(req.Header) {
+			rw.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(rw)
+			defer gz.Close()
+			w = gz
+		}
+		enc := expfmt.NewEncoder(w, format, expfmt.WithUnit(), expfmt.WithCreatedLines())
+		for _, mf := range mfs {
+			if err := enc.Encode(mf); err != nil {
+				log.Println("Failed to encode metrics:", err)
+				return
+			}
+		}
+		if closer, ok := enc.(expfmt.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of a request allows
+// gzip.
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			enc, params, _ := strings.Cut(part, ";")
+			if strings.TrimSpace(enc) != "gzip" {
+				continue
+			}
+			// An encoding with zero quality is not acceptable.
+			q := 1.0
+			if p := strings.TrimSpace(params); strings.HasPrefix(p, "q=") {
+				q, _ = strconv.ParseFloat(p[len("q="):], 64)
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// readyStatus is the response of the ready handler.
+type readyStatus struct {
+	Ready   bool     `json:"ready"`
+	Pending []string `json:"pending"`
+}
+
+// readyHandler reports whether every critical file has succeeded at least
+// once, or has restored cached results. If no file is critical, then every file must succeed. The handler
+// responds with status 200 when ready, and 503 with the names of pending
+// files otherwise.
+func readyHandler(files []setup.File) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		critical := false
+		for i := range files {
+			critical = critical || files[i].Config.Critical
+		}
+		status := readyStatus{Pending: []string{}}
+		for i := range files {
+			if critical && !files[i].Config.Critical {
+				continue
+			}
+			if s := files[i].Status(); s.LastSuccess.IsZero() && s.Restored.IsZero() {
+				status.Pending = append(status.Pending, files[i].Name)
+			}
+		}
+		status.Ready = len(status.Pending) == 0
+		rw.Header().Set("Content-Type", "application/json")
+		if !status.Ready {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(rw).Encode(status)
+	}
+}
+
+// healthStatus is the response of the health handler.
+type healthStatus struct {
+	Healthy  bool      `json:"healthy"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// healthzHandler reports whether the refresh loop is making progress, as
+// detected by the given watchdog. The handler responds with status 200 when
+// healthy, and 503 otherwise.
+func healthzHandler(w *watchdog.Watchdog) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		status := healthStatus{}
+		status.Healthy, status.Deadline = w.Healthy(time.Now())
+		rw.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(rw).Encode(status)
+	}
+}
+
+// runStatus is the outcome of the latest run of a file, as reported by the
+// admin handlers.
+type runStatus struct {
+	File            string  `json:"file"`
+	Success         bool    `json:"success"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// writeRunStatus writes the status of the given files as json. The response
+// status is 500 if any file failed.
+func writeRunStatus(rw http.ResponseWriter, files []*setup.File) {
+	result := []runStatus{}
+	code := http.StatusOK
+	for _, f := range files {
+		s := f.Status()
+		r := runStatus{
+			File:            f.Name,
+			Success:         s.LastError == nil,
+			DurationSeconds: s.LastDuration.Seconds(),
+		}
+		if s.LastError != nil {
+			r.Error = s.LastError.Error()
+			code = http.StatusInternalServerError
+		}
+		result = append(result, r)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(result)
+}
+
+// adminAuth only calls the given handler for POST requests with an
+// "Authorization: Bearer <token>" header.
+func adminAuth(token string, h http.HandlerFunc) http.HandlerFunc {
+	want := []byte("Bearer " + token)
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		got := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(rw, req)
+	}
+}
+
+// refreshHandler runs the file named by the "query" parameter immediately and
+// responds with the result. The query may be the file name or the metric name
+// derived from it, without the namespace.
+func refreshHandler(files []setup.File, update updateFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		name := req.URL.Query().Get("query")
+		if name == "" {
+			http.Error(rw, "missing query parameter", http.StatusBadRequest)
+			return
+		}
+		for i := range files {
+			if files[i].Name != name && fileToMetric(files[i].Name) != name {
+				continue
+			}
+			ran := update(files[i:i+1], updateNow)
+			if len(ran) == 0 {
+				http.Error(rw, "query did not run", http.StatusServiceUnavailable)
+				return
+			}
+			writeRunStatus(rw, ran)
+			return
+		}
+		http.Error(rw, "unknown query "+name, http.StatusNotFound)
+	}
+}
+
+// reloadHandler registers new or modified files immediately and responds with
+// the results of the files that were reloaded.
+func reloadHandler(files []setup.File, update updateFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		writeRunStatus(rw, update(files, updateModified))
+	}
+}
+
+// fileStatus describes a file on the status page.
+type fileStatus struct {
+	File                string    `json:"file"`
+	Metric              string    `json:"metric"`
+	Query               string    `json:"query"`
+	Schedule            string    `json:"schedule"`
+	Next                time.Time `json:"next"`
+	Runs                int       `json:"runs"`
+	LastRun             time.Time `json:"last_run"`
+	LastDurationSeconds float64   `json:"last_duration_seconds"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastError           string    `json:"last_error,omitempty"`
+	Skips               int       `json:"skips"`
+	Restored            time.Time `json:"restored"`
+	Rows                int       `json:"rows"`
+	BytesBilled         int64     `json:"bytes_billed"`
+	Series              []string  `json:"series"`
+}
+
+// newFileStatus collects the status of the given file.
+func newFileStatus(f *setup.File) fileStatus {
+	s := f.Status()
+	fs := fileStatus{
+		File:                f.Name,
+		Metric:              *namespace + fileToMetric(f.Name),
+		Query:               f.Query(),
+		Schedule:            "every " + refresh.String(),
+		Next:                f.Next(),
+		Runs:                s.Runs,
+		LastRun:             s.LastRun,
+		LastDurationSeconds: s.LastDuration.Seconds(),
+		LastSuccess:         s.LastSuccess,
+		Skips:               s.Skips,
+		Restored:            s.Restored,
+		Series:              []string{},
+	}
+	if f.Config.Schedule != "" {
+		fs.Schedule = strings.TrimSpace(f.Config.Schedule + " " + f.Config.Timezone)
+	}
+	if s.LastError != nil {
+		fs.LastError = s.LastError.Error()
+	}
+	if r := f.Results(); r != nil {
+		fs.Rows = len(r.Metrics)
+		fs.BytesBilled = r.Stats.BytesBilled
+	}
+	mfs, err := f.Gather()
+	if err != nil {
+		fs.Series = append(fs.Series, "# error: "+err.Error())
+	}
+	for _, mf := range mfs {
+		var b bytes.Buffer
+		expfmt.MetricFamilyToText(&b, mf)
+		for _, line := range strings.Split(b.String(), "\n") {
+			if line != "" && !strings.HasPrefix(line, "#") {
+				fs.Series = append(fs.Series, line)
+			}
+		}
+	}
+	return fs
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>BigQuery Exporter Status</title></head>
+<body>
+<h1>Queries</h1>
+<table border="1" cellpadding="4">
+<tr>
+  <th>File</th><th>Metric</th><th>Schedule</th><th>Next</th><th>Runs</th>
+  <th>Skips</th><th>Last run</th><th>Duration</th><th>Last success</th><th>Rows</th>
+  <th>Bytes billed</th><th>Last error</th>
+</tr>
+{{range .}}
+<tr>
+  <td>{{.File}}</td><td>{{.Metric}}</td><td>{{.Schedule}}</td>
+  <td>{{.Next.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Runs}}</td>
+  <td>{{.Skips}}</td><td>{{.LastRun.Format "2006-01-02 15:04:05 MST"}}</td><td>{{printf "%.3fs" .LastDurationSeconds}}</td>
+  <td>{{.LastSuccess.Format "2006-01-02 15:04:05 MST"}}</td><td>{{.Rows}}</td>
+  <td>{{.BytesBilled}}</td><td>{{.LastError}}</td>
+</tr>
+<tr>
+  <td colspan="12">
+    <details><summary>Query</summary><pre>{{.Query}}</pre></details>
+    <details><summary>Series ({{len .Series}})</summary><pre>{{range .Series}}{{.}}
+{{end}}</pre></details>
+  </td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// statusHandler reports the status of every file as an HTML page, or as json
+// when the request has a "format=json" parameter or accepts
+// "application/json".
+func statusHandler(files []setup.File) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		status := make([]fileStatus, len(files))
+		for i := range files {
+			status[i] = newFileStatus(&files[i])
+		}
+		if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(status)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		statusTemplate.Execute(rw, status)
+	}
+}
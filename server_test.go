@@ -0,0 +1,404 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/config"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/watchdog"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+func Test_adminHandlers(t *testing.T) {
+	files := []setup.File{{Name: "/queries/a.sql"}, {Name: "/queries/b.sql"}}
+	var modes []updateMode
+	update := func(f []setup.File, mode updateMode) []*setup.File {
+		modes = append(modes, mode)
+		ran := []*setup.File{}
+		for i := range f {
+			if f[i].Name == "/queries/b.sql" {
+				f[i].RecordRun(time.Now(), fmt.Errorf("fake error"))
+			} else {
+				f[i].RecordRun(time.Now(), nil)
+			}
+			ran = append(ran, &f[i])
+		}
+		return ran
+	}
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		token    string
+		wantCode int
+		wantMode []updateMode
+		want     []runStatus
+	}{
+		{
+			name:     "refresh-metric-name",
+			method:   "POST",
+			url:      "/-/refresh?query=a",
+			token:    "secret",
+			wantCode: http.StatusOK,
+			wantMode: []updateMode{updateNow},
+			want:     []runStatus{{File: "/queries/a.sql", Success: true}},
+		},
+		{
+			name:     "refresh-file-name-failed",
+			method:   "POST",
+			url:      "/-/refresh?query=/queries/b.sql",
+			token:    "secret",
+			wantCode: http.StatusInternalServerError,
+			wantMode: []updateMode{updateNow},
+			want:     []runStatus{{File: "/queries/b.sql", Error: "fake error"}},
+		},
+		{
+			name:     "refresh-unknown",
+			method:   "POST",
+			url:      "/-/refresh?query=c",
+			token:    "secret",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "refresh-missing-query",
+			method:   "POST",
+			url:      "/-/refresh",
+			token:    "secret",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "reload",
+			method:   "POST",
+			url:      "/-/reload",
+			token:    "secret",
+			wantCode: http.StatusInternalServerError,
+			wantMode: []updateMode{updateModified},
+			want: []runStatus{
+				{File: "/queries/a.sql", Success: true},
+				{File: "/queries/b.sql", Error: "fake error"},
+			},
+		},
+		{
+			name:     "error-wrong-token",
+			method:   "POST",
+			url:      "/-/reload",
+			token:    "wrong",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "error-get",
+			method:   "GET",
+			url:      "/-/reload",
+			token:    "secret",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+	mux := newServeMux(files, "secret", update)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modes = nil
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rw := httptest.NewRecorder()
+			mux.ServeHTTP(rw, req)
+			if rw.Code != tt.wantCode {
+				t.Errorf("admin handler code = %d, want %d", rw.Code, tt.wantCode)
+			}
+			if !reflect.DeepEqual(modes, tt.wantMode) {
+				t.Errorf("admin handler modes = %v, want %v", modes, tt.wantMode)
+			}
+			if tt.want == nil {
+				return
+			}
+			got := []runStatus{}
+			if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil {
+				t.Fatalf("admin handler returned invalid json: %v", err)
+			}
+			for i := range got {
+				got[i].DurationSeconds = 0
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("admin handler = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newServeMux_noAdmin(t *testing.T) {
+	mux := newServeMux(nil, "", nil)
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest("POST", "/-/reload", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("newServeMux() /-/reload code = %d, want %d", rw.Code, http.StatusNotFound)
+	}
+}
+
+func Test_newServeMux_pprof(t *testing.T) {
+	mux := newServeMux(nil, "", nil)
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+		rw := httptest.NewRecorder()
+		mux.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != http.StatusOK {
+			t.Errorf("newServeMux() %s code = %d, want %d", path, rw.Code, http.StatusOK)
+		}
+	}
+}
+
+func Test_statusHandler(t *testing.T) {
+	files := []setup.File{
+		{Name: "/queries/status_a.sql"},
+		{Name: "/queries/status_b.sql", Config: config.Query{Schedule: "15 2 * * *", Timezone: "UTC"}},
+	}
+	c := sql.NewCollector(&fakeRunner{}, prometheus.GaugeValue, "status_a", "SELECT 1", nil)
+	rtx.Must(files[0].Register(c), "Failed to register collector")
+	defer prometheus.Unregister(c)
+	files[0].RecordRun(time.Now(), nil)
+	files[1].RecordRun(time.Now(), fmt.Errorf("fake error"))
+
+	mux := newServeMux(files, "", nil)
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest("GET", "/status?format=json", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("statusHandler() code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	got := []fileStatus{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil {
+		t.Fatalf("statusHandler() returned invalid json: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("statusHandler() returned %d files, want 2", len(got))
+	}
+	a, b := got[0], got[1]
+	if a.Metric != "status_a" || a.Query != "SELECT 1" || a.Rows != 1 || a.Runs != 1 {
+		t.Errorf("statusHandler() = %#v, want registered status_a", a)
+	}
+	wantSeries := []string{`status_aokay{key="value"} 1.23`}
+	if !reflect.DeepEqual(a.Series, wantSeries) {
+		t.Errorf("statusHandler() series = %q, want %q", a.Series, wantSeries)
+	}
+	if b.Schedule != "15 2 * * * UTC" || b.LastError != "fake error" || len(b.Series) != 0 {
+		t.Errorf("statusHandler() = %#v, want failed status_b", b)
+	}
+
+	rw = httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest("GET", "/status", nil))
+	if ct := rw.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("statusHandler() content type = %q, want text/html", ct)
+	}
+	if !strings.Contains(rw.Body.String(), "fake error") {
+		t.Errorf("statusHandler() html does not contain the last error")
+	}
+}
+
+func Test_readyHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []setup.File
+		restored bool
+		wantCode int
+		want     readyStatus
+	}{
+		{
+			name:     "pending",
+			files:    []setup.File{{Name: "a.sql"}, {Name: "b.sql"}, {Name: "c.sql"}},
+			wantCode: http.StatusServiceUnavailable,
+			want:     readyStatus{Pending: []string{"b.sql", "c.sql"}},
+		},
+		{
+			name:     "restored",
+			files:    []setup.File{{Name: "a.sql"}, {Name: "b.sql"}, {Name: "c.sql"}},
+			restored: true,
+			wantCode: http.StatusServiceUnavailable,
+			want:     readyStatus{Pending: []string{"b.sql"}},
+		},
+		{
+			name:     "all-required",
+			files:    []setup.File{{Name: "a.sql"}, {Name: "b.sql"}},
+			wantCode: http.StatusServiceUnavailable,
+			want:     readyStatus{Pending: []string{"b.sql"}},
+		},
+		{
+			name:     "critical-pending",
+			files:    []setup.File{{Name: "a.sql"}, {Name: "b.sql", Config: config.Query{Critical: true}}},
+			wantCode: http.StatusServiceUnavailable,
+			want:     readyStatus{Pending: []string{"b.sql"}},
+		},
+		{
+			name:     "critical-ready",
+			files:    []setup.File{{Name: "a.sql", Config: config.Query{Critical: true}}, {Name: "b.sql"}},
+			wantCode: http.StatusOK,
+			want:     readyStatus{Ready: true, Pending: []string{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first file succeeds, and the second file fails.
+			tt.files[0].RecordRun(time.Now(), nil)
+			tt.files[1].RecordRun(time.Now(), fmt.Errorf("fake error"))
+			if tt.restored {
+				// The last file restored cached results.
+				tt.files[len(tt.files)-1].RecordRestore(time.Now())
+			}
+			mux := newServeMux(tt.files, "", nil)
+			for _, path := range []string{"/ready", "/readyz"} {
+				rw := httptest.NewRecorder()
+				mux.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+				if rw.Code != tt.wantCode {
+					t.Errorf("readyHandler(%s) code = %d, want %d", path, rw.Code, tt.wantCode)
+				}
+				got := readyStatus{}
+				if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil {
+					t.Fatalf("readyHandler(%s) returned invalid json: %v", path, err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("readyHandler(%s) = %#v, want %#v", path, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func Test_healthzHandler(t *testing.T) {
+	w := watchdog.New()
+	tests := []struct {
+		name     string
+		kick     time.Duration
+		wantCode int
+	}{
+		{name: "healthy", kick: time.Hour, wantCode: http.StatusOK},
+		{name: "wedged", kick: time.Nanosecond, wantCode: http.StatusServiceUnavailable},
+		{name: "disabled", kick: 0, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w.Kick(tt.kick)
+			time.Sleep(time.Millisecond)
+			rw := httptest.NewRecorder()
+			healthzHandler(w).ServeHTTP(rw, httptest.NewRequest("GET", "/healthz", nil))
+			if rw.Code != tt.wantCode {
+				t.Errorf("healthzHandler() code = %d, want %d", rw.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+type createdRunner struct{}
+
+func (createdRunner) Query(query string) ([]sql.Metric, error) {
+	m := sql.NewMetric(nil, nil, map[string]float64{"": 3})
+	m.Created = time.Unix(1583020800, 0)
+	return []sql.Metric{m}, nil
+}
+
+func Test_metricsHandler(t *testing.T) {
+	files := []setup.File{{Name: "/queries/metrics_a.sql"}}
+	c := sql.NewCollector(createdRunner{}, prometheus.CounterValue, "metrics_a", "", nil)
+	c.SetUnit("bytes")
+	rtx.Must(files[0].Register(c), "Failed to register collector")
+	defer prometheus.Unregister(c)
+
+	mux := newServeMux(files, "", nil)
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	mux.ServeHTTP(rw, req)
+	if ct := rw.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("metricsHandler() content type = %q, want openmetrics", ct)
+	}
+	for _, want := range []string{
+		"# UNIT metrics_a_bytes bytes\n",
+		"# TYPE metrics_a_bytes counter\n",
+		"metrics_a_bytes_total 3.0\n",
+		"metrics_a_bytes_created 1.5830208e+09\n",
+		"# EOF\n",
+	} {
+		if !strings.Contains(rw.Body.String(), want) {
+			t.Errorf("metricsHandler() does not contain %q:\n%s", want, rw.Body.String())
+		}
+	}
+
+	// Without OpenMetrics, the text format is used.
+	rw = httptest.NewRecorder()
+	mux.ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rw.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("metricsHandler() content type = %q, want text/plain", ct)
+	}
+	if !strings.Contains(rw.Body.String(), "metrics_a_bytes_total 3\n") {
+		t.Errorf("metricsHandler() does not contain metrics_a_bytes_total:\n%s", rw.Body.String())
+	}
+
+	// The metrics are compressed when the scraper accepts gzip.
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	mux.ServeHTTP(rw, req)
+	if ce := rw.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("metricsHandler() content encoding = %q, want gzip", ce)
+	}
+	gz, err := gzip.NewReader(rw.Body)
+	rtx.Must(err, "Failed to read gzip response")
+	b, err := ioutil.ReadAll(gz)
+	rtx.Must(err, "Failed to read gzip response")
+	if !strings.Contains(string(b), "metrics_a_bytes_total 3\n") {
+		t.Errorf("metricsHandler() does not contain metrics_a_bytes_total:\n%s", b)
+	}
+}
+
+func Test_metricsHandler_gatherError(t *testing.T) {
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return []*dto.MetricFamily{{
+			Name:   proto.String("partial"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		}}, fmt.Errorf("fake error")
+	})
+	rw := httptest.NewRecorder()
+	metricsHandler(g).ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "partial 1\n") {
+		t.Errorf("metricsHandler() = %d %q, want the gathered metrics", rw.Code, rw.Body.String())
+	}
+
+	g = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, fmt.Errorf("fake error")
+	})
+	rw = httptest.NewRecorder()
+	metricsHandler(g).ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if rw.Code != http.StatusInternalServerError {
+		t.Errorf("metricsHandler() code = %d, want %d", rw.Code, http.StatusInternalServerError)
+	}
+}
+
+func Test_acceptsGzip(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{value: "", want: false},
+		{value: "gzip", want: true},
+		{value: "deflate, gzip;q=0.5", want: true},
+		{value: "gzip;q=0", want: false},
+		{value: "identity", want: false},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.value != "" {
+			h.Set("Accept-Encoding", tt.value)
+		}
+		if got := acceptsGzip(h); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
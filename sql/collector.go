@@ -2,8 +2,12 @@
 package sql
 
 import (
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/m-lab/go/logx"
@@ -16,6 +20,15 @@ type Metric struct {
 	LabelKeys   []string
 	LabelValues []string
 	Values      map[string]float64
+	// Timestamp is the time of the values, or zero if the query does not
+	// report one.
+	Timestamp time.Time
+	// Created is the time counter values started to accumulate, or zero if
+	// the query does not report one.
+	Created time.Time
+	// Exemplar holds the labels of an exemplar for counter values, e.g. a
+	// trace ID, or nil if the query does not report one.
+	Exemplar map[string]string
 }
 
 // NewMetric creates a Metric with given values.
@@ -32,6 +45,111 @@ type QueryRunner interface {
 	Query(q string) ([]Metric, error)
 }
 
+// Schema describes the label keys and value suffixes of every Metric returned
+// by a query. Unlike the metrics, the schema is known even when a query returns
+// no rows.
+type Schema struct {
+	// LabelKeys are the sorted label names, as in Metric.LabelKeys.
+	LabelKeys []string
+	// ValueKeys are the sorted value suffixes, as in the keys of Metric.Values.
+	ValueKeys []string
+}
+
+// SchemaQueryRunner is an optional interface for QueryRunners that report the
+// query result schema alongside the metrics.
+type SchemaQueryRunner interface {
+	QueryRunner
+	QuerySchema(q string) ([]Metric, *Schema, error)
+}
+
+// Stats holds statistics about a query.
+type Stats struct {
+	// BytesBilled is the number of bytes billed for the query, or zero if
+	// unknown.
+	BytesBilled int64
+}
+
+// StatsQueryRunner is an optional interface for QueryRunners that report
+// statistics about the most recent query.
+type StatsQueryRunner interface {
+	QueryRunner
+	LastStats() Stats
+}
+
+// Equal reports whether both schemas have the same label keys and value keys.
+func (s *Schema) Equal(o *Schema) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	return equalStrings(s.LabelKeys, o.LabelKeys) && equalStrings(s.ValueKeys, o.ValueKeys)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// metricSchema derives a Schema from the given metric.
+func metricSchema(m Metric) *Schema {
+	s := &Schema{
+		LabelKeys: m.LabelKeys,
+		ValueKeys: make([]string, 0, len(m.Values)),
+	}
+	for k := range m.Values {
+		s.ValueKeys = append(s.ValueKeys, k)
+	}
+	sort.Strings(s.ValueKeys)
+	return s
+}
+
+// snapshot holds an immutable set of cached metrics together with the
+// descriptions used to report them. A snapshot is never modified after it is
+// stored in a Collector, so readers do not need a lock.
+type snapshot struct {
+	// metrics caches the last set of collected results from a query.
+	metrics []Metric
+	// reported are the metrics reported by Collect. When metrics have
+	// timestamps, only the latest metric for every set of label values is
+	// reported.
+	reported []Metric
+	// descs maps metric suffixes to the prometheus description. These
+	// descriptions are generated once and must be stable over time.
+	descs map[string]*prometheus.Desc
+	// names maps metric suffixes to the metric names of descs.
+	names map[string]string
+	// schema is the schema used to create descs, if any.
+	schema *Schema
+	// updated is the start time of the query that produced the metrics.
+	updated time.Time
+	// stats are the statistics of the query that produced the metrics.
+	stats Stats
+}
+
+// Results holds the metrics and schema returned by a successful query.
+type Results struct {
+	// Metrics are the cached query results.
+	Metrics []Metric
+	// Schema describes the metrics. Schema may be nil if a query returned no
+	// rows and the QueryRunner does not report a schema.
+	Schema *Schema
+	// Updated is the start time of the query that produced the results.
+	Updated time.Time
+	// Stats are the statistics of the query that produced the results.
+	Stats Stats
+	// Names maps the value suffixes of the metrics to the metric names
+	// reported by the collector, including the namespace and any unit or
+	// "_total" suffix. Names is set by Collector.Results, and is empty until
+	// the metrics are described.
+	Names map[string]string
+}
+
 // Collector manages a prometheus.Collector for queries performed by a QueryRunner.
 type Collector struct {
 	// runner must be a QueryRunner instance for collecting metrics.
@@ -40,51 +158,132 @@ type Collector struct {
 	metricName string
 	// query contains the standardSQL query.
 	query string
+	// constLabels are added to every metric created for this query.
+	constLabels prometheus.Labels
 
 	// valType defines whether the metric is a Gauge or Counter type.
 	valType prometheus.ValueType
-	// descs maps metric suffixes to the prometheus description. These descriptions
-	// are generated once and must be stable over time.
-	descs map[string]*prometheus.Desc
+	// unit is the unit of every metric, e.g. "seconds", or empty if unknown.
+	unit string
 
-	// metrics caches the last set of collected results from a query.
-	metrics []Metric
-	// mux locks access to types above.
+	// maxStaleness is the maximum age of cached metrics. Zero disables expiration.
+	maxStaleness time.Duration
+	// dropStale is true if expired metrics should no longer be reported.
+	dropStale bool
+
+	// current holds the latest snapshot. Collect reads the snapshot without
+	// locking, while Update replaces it atomically.
+	current atomic.Pointer[snapshot]
+	// described is true after the first call to Describe.
+	described bool
+	// async is true if registration should not run the query.
+	async bool
+	// declared is true if the schema was declared with SetSchema.
+	declared bool
+	// mux serializes Describe and Update, which replace the current snapshot.
 	mux sync.Mutex
 
 	// RegisterErr contains any error during registration. This should be considered fatal.
 	RegisterErr error
 }
 
-// NewCollector creates a new BigQuery Collector instance.
-func NewCollector(runner QueryRunner, valType prometheus.ValueType, metricName, query string) *Collector {
+// NewCollector creates a new BigQuery Collector instance. The constLabels are
+// added to every metric reported by the collector and may be nil.
+func NewCollector(runner QueryRunner, valType prometheus.ValueType, metricName, query string, constLabels prometheus.Labels) *Collector {
 	return &Collector{
-		runner:     runner,
-		metricName: metricName,
-		query:      query,
-		valType:    valType,
-		descs:      nil,
-		metrics:    nil,
-		mux:        sync.Mutex{},
+		runner:      runner,
+		metricName:  metricName,
+		query:       query,
+		constLabels: constLabels,
+		valType:     valType,
+	}
+}
+
+// SetMaxStaleness configures the collector to expire cached metrics that are
+// older than d after the last successful Update. Expired metrics are no longer
+// reported if drop is true. Whenever d is positive, Staleness reports whether
+// the cached metrics of the collector are expired. SetMaxStaleness must be
+// called before the collector is registered.
+func (col *Collector) SetMaxStaleness(d time.Duration, drop bool) {
+	col.maxStaleness = d
+	col.dropStale = drop
+	Staleness.set(col)
+}
+
+// stale reports whether the cached metrics are missing or older than the
+// maximum staleness at the given time.
+func (col *Collector) stale(now time.Time) bool {
+	s := col.current.Load()
+	return s == nil || now.Sub(s.updated) > col.maxStaleness
+}
+
+// SetAsync configures whether registration runs the query. When async is
+// true, Describe only reports descriptions for a declared schema or restored
+// results, and the caller is responsible for calling Update after
+// registration. SetAsync must be called before the collector is registered.
+func (col *Collector) SetAsync(async bool) {
+	col.async = async
+}
+
+// SetUnit configures the unit of every metric reported by the collector, e.g.
+// "seconds". Metric names that do not end with the unit get the unit as an
+// additional suffix, before the "_total" suffix of counters. SetUnit must be
+// called before the collector is registered.
+func (col *Collector) SetUnit(unit string) {
+	col.unit = unit
+}
+
+// Units maps the name of every metric reported by the collector to its unit.
+// Units is empty if no unit is configured or the metrics are not described yet.
+func (col *Collector) Units() map[string]string {
+	units := map[string]string{}
+	s := col.current.Load()
+	if col.unit == "" || s == nil {
+		return units
 	}
+	for _, name := range s.names {
+		units[name] = col.unit
+	}
+	return units
+}
+
+// SetSchema declares the schema of the query results before the query runs,
+// so that the collector describes its metrics during registration. Query
+// results with a different schema are rejected by Update. SetSchema must be
+// called before the collector is registered.
+func (col *Collector) SetSchema(schema *Schema) error {
+	col.mux.Lock()
+	defer col.mux.Unlock()
+	col.declared = true
+	return col.store(&Results{Schema: schema})
 }
 
 // Describe satisfies the prometheus.Collector interface. Describe is called
 // immediately after registering the collector.
 func (col *Collector) Describe(ch chan<- *prometheus.Desc) {
 	logx.Debug.Println("Describe:", time.Now())
-	if col.descs == nil {
+	col.mux.Lock()
+	described := col.described
+	col.described = true
+	col.mux.Unlock()
+	// Restored results are reported until the next Update.
+	if !described && !col.async && col.Results() == nil {
 		// TODO: collect metrics for query exec time.
-		col.descs = make(map[string]*prometheus.Desc, 1)
 		err := col.Update()
 		if err != nil {
 			log.Println(err)
 			col.RegisterErr = err
 		}
-		col.setDesc()
 	}
-	// NOTE: if Update returns no metrics, this will fail.
-	for _, desc := range col.descs {
+	// NOTE: if the query schema is unknown because the query returned no rows
+	// and the runner does not report a schema, then no descs are sent and the
+	// collector is registered as "unchecked". Descs are created by the first
+	// Update that returns results.
+	s := col.current.Load()
+	if s == nil {
+		return
+	}
+	for _, desc := range s.descs {
 		ch <- desc
 	}
 }
@@ -93,50 +292,240 @@ func (col *Collector) Describe(ch chan<- *prometheus.Desc) {
 // from cached metrics.
 func (col *Collector) Collect(ch chan<- prometheus.Metric) {
 	logx.Debug.Println("Collect:", time.Now())
-	col.mux.Lock()
-	// Get reference to current metrics slice to allow Update to run concurrently.
-	metrics := col.metrics
-	col.mux.Unlock()
-
-	for i := range col.metrics {
-		for k, desc := range col.descs {
+	// Get reference to current snapshot to allow Update to run concurrently.
+	s := col.current.Load()
+	if col.maxStaleness > 0 && col.dropStale && col.stale(time.Now()) {
+		return
+	}
+	if s == nil {
+		return
+	}
+	for i := range s.reported {
+		for k, desc := range s.descs {
 			logx.Debug.Printf("%s labels:%#v values:%#v",
-				col.metricName, metrics[i].LabelValues, metrics[i].Values[k])
-			ch <- prometheus.MustNewConstMetric(
-				desc, col.valType, metrics[i].Values[k], metrics[i].LabelValues...)
+				col.metricName, s.reported[i].LabelValues, s.reported[i].Values[k])
+			ch <- col.newMetric(desc, s.reported[i], s.reported[i].Values[k], s.updated)
 		}
 	}
 }
 
+// newMetric creates the metric for a single value of m. Counters report the
+// created time and exemplar of m, if any. Exemplars without a timestamp of
+// their own use the query start time, updated. If m does not match desc, e.g.
+// after the query schema changed, newMetric returns an invalid metric, which
+// is reported as an error by the registry instead of a panic.
+func (col *Collector) newMetric(desc *prometheus.Desc, m Metric, val float64, updated time.Time) prometheus.Metric {
+	var metric prometheus.Metric
+	var err error
+	if col.valType != prometheus.CounterValue || m.Created.IsZero() {
+		metric, err = prometheus.NewConstMetric(desc, col.valType, val, m.LabelValues...)
+	} else {
+		metric, err = prometheus.NewConstMetricWithCreatedTimestamp(desc, col.valType, val, m.Created, m.LabelValues...)
+	}
+	if err != nil {
+		return prometheus.NewInvalidMetric(desc, err)
+	}
+	if col.valType != prometheus.CounterValue || len(m.Exemplar) == 0 {
+		return metric
+	}
+	ts := m.Timestamp
+	if ts.IsZero() {
+		ts = updated
+	}
+	em, err := prometheus.NewMetricWithExemplars(metric, prometheus.Exemplar{Value: val, Labels: m.Exemplar, Timestamp: ts})
+	if err != nil {
+		// Exemplars with invalid or too long labels are not reported.
+		logx.Debug.Println(col.metricName, "invalid exemplar:", err)
+		return metric
+	}
+	return em
+}
+
 // String satisfies the Stringer interface. String returns the metric name.
 func (col *Collector) String() string {
 	return col.metricName
 }
 
+// Query returns the query run by the collector.
+func (col *Collector) Query() string {
+	return col.query
+}
+
 // Update runs the collector query and atomically updates the cached metrics.
 // Update is called automaticlly after the collector is registered.
 func (col *Collector) Update() error {
 	logx.Debug.Println("Update:", col.metricName)
-	metrics, err := col.runner.Query(col.query)
+	// Results reflect the data as of the start of the query.
+	start := time.Now()
+	metrics, schema, err := col.run()
 	if err != nil {
 		logx.Debug.Println("Failed to run query:", err)
 		return err
 	}
-	// Swap the cached metrics.
+	r := &Results{Metrics: metrics, Schema: schema, Updated: start}
+	if sr, ok := col.runner.(StatsQueryRunner); ok {
+		r.Stats = sr.LastStats()
+	}
+	col.mux.Lock()
+	defer col.mux.Unlock()
+	return col.store(r)
+}
+
+// Results returns the cached query results, or nil if no query has succeeded.
+func (col *Collector) Results() *Results {
+	s := col.current.Load()
+	if s == nil || s.updated.IsZero() {
+		return nil
+	}
+	return &Results{Metrics: s.metrics, Schema: s.schema, Updated: s.updated, Stats: s.stats, Names: s.names}
+}
+
+// Touch marks the cached metrics as current as of t, e.g. when the query was
+// skipped because its source tables are unchanged, so that they do not expire.
+// Touch does nothing if there are no cached results or they are newer than t.
+func (col *Collector) Touch(t time.Time) {
+	col.mux.Lock()
+	defer col.mux.Unlock()
+	prev := col.current.Load()
+	if prev == nil || prev.updated.IsZero() || !t.After(prev.updated) {
+		return
+	}
+	next := *prev
+	next.updated = t
+	col.current.Store(&next)
+}
+
+// Restore replaces the cached metrics with previously saved results, e.g.
+// after a restart. When Restore is called before the collector is registered,
+// registration reports the restored results instead of running the query.
+func (col *Collector) Restore(r *Results) error {
 	col.mux.Lock()
 	defer col.mux.Unlock()
-	// Replace slice reference with new value returned from Query. References
-	// to the previous value of col.metrics are not affected.
-	col.metrics = metrics
-	return nil
-}
-
-func (col *Collector) setDesc() {
-	// The query may return no results.
-	if len(col.metrics) > 0 {
-		for k := range col.metrics[0].Values {
-			// TODO: allow passing meaningful help text.
-			col.descs[k] = prometheus.NewDesc(col.metricName+k, "help text", col.metrics[0].LabelKeys, nil)
+	return col.store(r)
+}
+
+// store atomically replaces the current snapshot with the given results. Descs
+// are created from the schema only if they have not been created before. If
+// descs were created before from a declared schema, then metrics with a
+// different schema are rejected. Otherwise, the change is logged, and the
+// metrics are reported with the existing descs until the collector is
+// registered again. The caller must hold mux.
+func (col *Collector) store(r *Results) error {
+	var err error
+	schema := r.Schema
+	next := &snapshot{
+		metrics:  r.Metrics,
+		reported: latestMetrics(r.Metrics),
+		schema:   schema,
+		updated:  r.Updated,
+		stats:    r.Stats,
+	}
+	if prev := col.current.Load(); prev != nil && len(prev.descs) > 0 {
+		if schema != nil && !schema.Equal(prev.schema) {
+			err := fmt.Errorf("%s: query schema changed from %v to %v", col.metricName, *prev.schema, *schema)
+			if col.declared {
+				return err
+			}
+			log.Println(err)
 		}
+		next.descs = prev.descs
+		next.names = prev.names
+		next.schema = prev.schema
+	}
+	if len(next.descs) == 0 && schema != nil {
+		next.descs, next.names, err = col.newDescs(schema)
+	}
+	// Swap the cached snapshot. References to the previous snapshot are not
+	// affected.
+	col.current.Store(next)
+	return err
+}
+
+// latestMetrics returns the metrics with the latest timestamp for every set of
+// label values, in the original order. Metrics without timestamps are
+// returned unchanged, since every set of label values is unique.
+func latestMetrics(metrics []Metric) []Metric {
+	timestamps := false
+	for i := range metrics {
+		timestamps = timestamps || !metrics[i].Timestamp.IsZero()
+	}
+	if !timestamps {
+		return metrics
+	}
+	latest := []Metric{}
+	index := map[string]int{}
+	for _, m := range metrics {
+		key := strings.Join(m.LabelValues, "\xff")
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(latest)
+			latest = append(latest, m)
+		} else if m.Timestamp.After(latest[i].Timestamp) {
+			latest[i] = m
+		}
+	}
+	return latest
+}
+
+// run runs the collector query. When the runner does not report a schema, the
+// schema is derived from the first metric, if any.
+func (col *Collector) run() ([]Metric, *Schema, error) {
+	if sr, ok := col.runner.(SchemaQueryRunner); ok {
+		return sr.QuerySchema(col.query)
+	}
+	metrics, err := col.runner.Query(col.query)
+	if err != nil || len(metrics) == 0 {
+		return metrics, nil, err
+	}
+	return metrics, metricSchema(metrics[0]), nil
+}
+
+// withSuffixes returns the metric name with the unit suffix, if any, followed
+// by the "_total" suffix for counters, as required by OpenMetrics.
+func (col *Collector) withSuffixes(name string) string {
+	counter := col.valType == prometheus.CounterValue
+	if counter && strings.HasSuffix(SanitizeName(name), "_total") {
+		name = name[:len(name)-len("_total")]
+	}
+	if col.unit != "" && !strings.HasSuffix(SanitizeName(name), "_"+col.unit) {
+		name += "_" + col.unit
+	}
+	if counter {
+		name += "_total"
+	}
+	return name
+}
+
+// newDescs creates descriptions for every value in the schema, and returns
+// them with their metric names, both keyed by value suffix. The metric name
+// suffixes and label keys are normalized to valid Prometheus names.
+func (col *Collector) newDescs(schema *Schema) (map[string]*prometheus.Desc, map[string]string, error) {
+	keys, err := sanitizeNames("label", schema.LabelKeys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", col.metricName, err)
+	}
+	for _, k := range keys {
+		if !ValidLabelName(k) {
+			return nil, nil, fmt.Errorf("%s: invalid label name %q", col.metricName, k)
+		}
+		if _, ok := col.constLabels[k]; ok {
+			return nil, nil, fmt.Errorf("%s: label %q is also a constant label", col.metricName, k)
+		}
+	}
+	names := make([]string, len(schema.ValueKeys))
+	for i, k := range schema.ValueKeys {
+		names[i] = col.withSuffixes(col.metricName + k)
+	}
+	names, err = sanitizeNames("metric", names)
+	if err != nil {
+		return nil, nil, err
+	}
+	descs := make(map[string]*prometheus.Desc, len(names))
+	byKey := make(map[string]string, len(names))
+	for i, k := range schema.ValueKeys {
+		// TODO: allow passing meaningful help text.
+		descs[k] = prometheus.NewDesc(names[i], "help text", keys, col.constLabels)
+		byKey[k] = names[i]
 	}
+	return descs, byKey, nil
 }
@@ -7,11 +7,15 @@ import (
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/prometheusx/promtest"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 type fakeQueryRunner struct {
@@ -49,7 +53,7 @@ func TestCollector(t *testing.T) {
 		`fake_metric{key="thing2"} 2.1`,
 	}
 	c := NewCollector(
-		&fakeQueryRunner{metrics}, prometheus.GaugeValue, "fake_metric", "-- not used")
+		&fakeQueryRunner{metrics}, prometheus.GaugeValue, "fake_metric", "-- not used", nil)
 
 	// NOTE: prometheus.Desc and prometheus.Metric are opaque interfaces that do
 	// not allow introspection. But, we know how many to expect, so check the
@@ -111,7 +115,7 @@ func TestCollector(t *testing.T) {
 
 func TestNewCollector(t *testing.T) {
 	r := &errorQueryRunner{}
-	c := NewCollector(r, prometheus.GaugeValue, "metric_name", "")
+	c := NewCollector(r, prometheus.GaugeValue, "metric_name", "", nil)
 	if c.String() != "metric_name" {
 		t.Errorf("NewCollector().String() got %q, want 'metric_name'", c.String())
 	}
@@ -133,3 +137,556 @@ func TestNewMetric(t *testing.T) {
 		t.Errorf("NewMetric() = %v, want %v", m, want)
 	}
 }
+
+func TestCollector_ConstLabels(t *testing.T) {
+	metrics := []Metric{
+		NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1.1}),
+	}
+	c := NewCollector(
+		&fakeQueryRunner{metrics}, prometheus.GaugeValue, "bqx_fake_metric", "",
+		prometheus.Labels{"env": "prod"})
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	if len(mfs) != 1 || mfs[0].GetName() != "bqx_fake_metric" {
+		t.Fatalf("Gather() got %v, want one bqx_fake_metric family", mfs)
+	}
+	labels := map[string]string{}
+	for _, l := range mfs[0].Metric[0].GetLabel() {
+		labels[l.GetName()] = l.GetValue()
+	}
+	want := map[string]string{"env": "prod", "key": "thing"}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("Collect() labels = %v, want %v", labels, want)
+	}
+}
+
+func TestCollector_SanitizeNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  Metric
+		labels  prometheus.Labels
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "success-sanitized",
+			metric: NewMetric([]string{"machine-name"}, []string{"mlab1"}, map[string]float64{"-p50": 1}),
+			want:   "fake_metric_p50",
+		},
+		{
+			name:    "error-value-collision",
+			metric:  NewMetric(nil, nil, map[string]float64{"_p50": 1, "-p50": 2}),
+			wantErr: true,
+		},
+		{
+			name:    "error-label-collision",
+			metric:  NewMetric([]string{"a-b", "a_b"}, []string{"x", "y"}, map[string]float64{"": 1}),
+			wantErr: true,
+		},
+		{
+			name:    "error-reserved-label",
+			metric:  NewMetric([]string{"__name"}, []string{"x"}, map[string]float64{"": 1}),
+			wantErr: true,
+		},
+		{
+			name:    "error-const-label-collision",
+			metric:  NewMetric([]string{"env"}, []string{"x"}, map[string]float64{"": 1}),
+			labels:  prometheus.Labels{"env": "prod"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(
+				&fakeQueryRunner{[]Metric{tt.metric}}, prometheus.GaugeValue, "fake_metric", "", tt.labels)
+			reg := prometheus.NewRegistry()
+			reg.Register(c)
+			if (c.RegisterErr != nil) != tt.wantErr {
+				t.Fatalf("Register() RegisterErr = %v, wantErr %t", c.RegisterErr, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("Gather() error = %v", err)
+			}
+			if len(mfs) != 1 || mfs[0].GetName() != tt.want {
+				t.Errorf("Gather() got %v, want %s", mfs, tt.want)
+			}
+		})
+	}
+}
+
+type schemaQueryRunner struct {
+	metrics []Metric
+	schema  *Schema
+}
+
+func (qr *schemaQueryRunner) Query(query string) ([]Metric, error) {
+	return qr.metrics, nil
+}
+
+func (qr *schemaQueryRunner) QuerySchema(query string) ([]Metric, *Schema, error) {
+	return qr.metrics, qr.schema, nil
+}
+
+func TestCollector_EmptyResults(t *testing.T) {
+	later := []Metric{
+		NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1.1, "_max": 2.2}),
+	}
+	tests := []struct {
+		name      string
+		runner    QueryRunner
+		wantDescs int
+	}{
+		{
+			name: "schema-runner",
+			runner: &schemaQueryRunner{
+				schema: &Schema{LabelKeys: []string{"key"}, ValueKeys: []string{"", "_max"}},
+			},
+			wantDescs: 2,
+		},
+		{
+			name:      "plain-runner",
+			runner:    &fakeQueryRunner{},
+			wantDescs: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(tt.runner, prometheus.GaugeValue, "fake_metric", "", nil)
+			chDesc := make(chan *prometheus.Desc, 2)
+			c.Describe(chDesc)
+			close(chDesc)
+			if len(chDesc) != tt.wantDescs {
+				t.Errorf("Describe() got %d descs, want %d", len(chDesc), tt.wantDescs)
+			}
+			if c.RegisterErr != nil {
+				t.Fatalf("Describe() RegisterErr = %v", c.RegisterErr)
+			}
+
+			// The query starts returning results.
+			switch r := tt.runner.(type) {
+			case *schemaQueryRunner:
+				r.metrics = later
+			case *fakeQueryRunner:
+				r.metrics = later
+			}
+			if err := c.Update(); err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+			chCol := make(chan prometheus.Metric, 2)
+			c.Collect(chCol)
+			close(chCol)
+			if len(chCol) != 2 {
+				t.Errorf("Collect() got %d metrics, want 2", len(chCol))
+			}
+		})
+	}
+}
+
+// shrinkingQueryRunner alternates between returning many and few metrics.
+type shrinkingQueryRunner struct {
+	count atomic.Int64
+}
+
+func (qr *shrinkingQueryRunner) Query(query string) ([]Metric, error) {
+	n := 10
+	if qr.count.Add(1)%2 == 0 {
+		n = 1
+	}
+	metrics := make([]Metric, n)
+	for i := range metrics {
+		metrics[i] = NewMetric([]string{"key"}, []string{fmt.Sprint(i)}, map[string]float64{"": float64(i)})
+	}
+	return metrics, nil
+}
+
+// TestCollector_ConcurrentUpdate simulates concurrent scrapes and refreshes.
+// Run with "go test -race" to detect data races.
+func TestCollector_ConcurrentUpdate(t *testing.T) {
+	c := NewCollector(&shrinkingQueryRunner{}, prometheus.GaugeValue, "fake_metric", "", nil)
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if err := c.Update(); err != nil {
+					t.Errorf("Update() error = %v", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if _, err := reg.Gather(); err != nil {
+					t.Errorf("Gather() error = %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCollector_SetMaxStaleness(t *testing.T) {
+	metrics := []Metric{
+		NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1.1}),
+	}
+	tests := []struct {
+		name        string
+		age         time.Duration
+		drop        bool
+		wantStale   float64
+		wantMetrics int
+	}{
+		{name: "fresh", age: 0, wantStale: 0, wantMetrics: 1},
+		{name: "stale-mark", age: 2 * time.Hour, wantStale: 1, wantMetrics: 1},
+		{name: "stale-drop", age: 2 * time.Hour, drop: true, wantStale: 1, wantMetrics: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(&fakeQueryRunner{metrics}, prometheus.GaugeValue, "fake_metric", "", prometheus.Labels{"env": "prod"})
+			c.SetMaxStaleness(time.Hour, tt.drop)
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(Staleness)
+			if err := reg.Register(c); err != nil {
+				t.Fatalf("Register() error = %v", err)
+			}
+			// Age the current snapshot.
+			s := *c.current.Load()
+			s.updated = s.updated.Add(-tt.age)
+			c.current.Store(&s)
+
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("Gather() error = %v", err)
+			}
+			got := map[string]*dto.MetricFamily{}
+			for _, mf := range mfs {
+				got[mf.GetName()] = mf
+			}
+			stale, ok := got["bqx_query_stale"]
+			if !ok || stale.Metric[0].GetGauge().GetValue() != tt.wantStale {
+				t.Errorf("Gather() bqx_query_stale = %v, want %v", stale, tt.wantStale)
+			}
+			if l := stale.GetMetric()[0].GetLabel(); len(l) != 1 || l[0].GetName() != "query" || l[0].GetValue() != "fake_metric" {
+				t.Errorf("Gather() bqx_query_stale labels = %v, want query", l)
+			}
+			if n := len(got["fake_metric"].GetMetric()); n != tt.wantMetrics {
+				t.Errorf("Gather() got %d fake_metric, want %d", n, tt.wantMetrics)
+			}
+		})
+	}
+}
+
+func TestCollector_SetMaxStaleness_constLabels(t *testing.T) {
+	metrics := []Metric{
+		NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1.1}),
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(Staleness)
+	// Queries with different constant label names share bqx_query_stale.
+	for name, labels := range map[string]prometheus.Labels{
+		"fake_a": {"env": "prod"},
+		"fake_b": {"env": "prod", "team": "ops"},
+	} {
+		c := NewCollector(&fakeQueryRunner{metrics}, prometheus.GaugeValue, name, "", labels)
+		c.SetMaxStaleness(time.Hour, true)
+		if err := reg.Register(c); err != nil {
+			t.Fatalf("Register(%s) error = %v", name, err)
+		}
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	queries := map[string]bool{}
+	for _, mf := range mfs {
+		if mf.GetName() != "bqx_query_stale" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			queries[m.GetLabel()[0].GetValue()] = true
+		}
+	}
+	if !queries["fake_a"] || !queries["fake_b"] {
+		t.Errorf("Gather() bqx_query_stale queries = %v, want fake_a and fake_b", queries)
+	}
+}
+
+func TestCollector_Touch(t *testing.T) {
+	c := NewCollector(&errorQueryRunner{}, prometheus.GaugeValue, "fake_metric", "", nil)
+	c.SetMaxStaleness(time.Hour, true)
+	// Touch without cached results does nothing.
+	c.Touch(time.Now())
+	if c.Results() != nil {
+		t.Fatalf("Results() got %v, want nil", c.Results())
+	}
+	saved := &Results{
+		Metrics: []Metric{NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1.1})},
+		Schema:  &Schema{LabelKeys: []string{"key"}, ValueKeys: []string{""}},
+		Updated: time.Now().Add(-2 * time.Hour),
+	}
+	if err := c.Restore(saved); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	now := time.Now()
+	c.Touch(now)
+	c.Touch(saved.Updated)
+	if r := c.Results(); !r.Updated.Equal(now) || !reflect.DeepEqual(r.Metrics, saved.Metrics) {
+		t.Errorf("Results() = %#v, want metrics updated at %v", r, now)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(Staleness)
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil || len(mfs) != 2 {
+		t.Errorf("Gather() = %v, %v; want touched metrics and bqx_query_stale", mfs, err)
+	}
+}
+
+func TestCollector_Restore(t *testing.T) {
+	r := &errorQueryRunner{}
+	c := NewCollector(r, prometheus.GaugeValue, "fake_metric", "", nil)
+	if c.Results() != nil {
+		t.Fatalf("Results() got %v, want nil", c.Results())
+	}
+	saved := &Results{
+		Metrics: []Metric{NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1.1})},
+		Schema:  &Schema{LabelKeys: []string{"key"}, ValueKeys: []string{""}},
+		Updated: time.Now().Add(-time.Minute),
+	}
+	if err := c.Restore(saved); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil || c.RegisterErr != nil {
+		t.Fatalf("Register() error = %v, %v", err, c.RegisterErr)
+	}
+	if r.count != 0 {
+		t.Errorf("Register() ran the query %d times, want 0", r.count)
+	}
+	mfs, err := reg.Gather()
+	if err != nil || len(mfs) != 1 || len(mfs[0].Metric) != 1 {
+		t.Errorf("Gather() = %v, %v; want one restored metric", mfs, err)
+	}
+	want := *saved
+	want.Names = map[string]string{"": "fake_metric"}
+	if !reflect.DeepEqual(c.Results(), &want) {
+		t.Errorf("Results() = %#v, want %#v", c.Results(), &want)
+	}
+}
+
+func TestCollector_SetAsync(t *testing.T) {
+	metrics := []Metric{
+		NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1.1}),
+	}
+	r := &fakeQueryRunner{metrics}
+	c := NewCollector(r, prometheus.GaugeValue, "fake_metric", "", nil)
+	c.SetAsync(true)
+	err := c.SetSchema(&Schema{LabelKeys: []string{"key"}, ValueKeys: []string{""}})
+	if err != nil {
+		t.Fatalf("SetSchema() error = %v", err)
+	}
+	if c.Results() != nil {
+		t.Errorf("Results() = %v, want nil before the first Update", c.Results())
+	}
+	chDesc := make(chan *prometheus.Desc, 2)
+	c.Describe(chDesc)
+	close(chDesc)
+	if len(chDesc) != 1 {
+		t.Errorf("Describe() got %d descs, want 1", len(chDesc))
+	}
+	chCol := make(chan prometheus.Metric, 2)
+	c.Collect(chCol)
+	if len(chCol) != 0 {
+		t.Errorf("Collect() got %d metrics before Update, want 0", len(chCol))
+	}
+	if err := c.Update(); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	c.Collect(chCol)
+	if len(chCol) != 1 {
+		t.Errorf("Collect() got %d metrics after Update, want 1", len(chCol))
+	}
+
+	// Results with a different schema are rejected.
+	r.metrics = []Metric{NewMetric([]string{"other"}, []string{"thing"}, map[string]float64{"": 1.1})}
+	if err := c.Update(); err == nil {
+		t.Errorf("Update() expected error for changed schema")
+	}
+	if got := c.Results().Metrics; !reflect.DeepEqual(got, metrics) {
+		t.Errorf("Results() = %v, want %v", got, metrics)
+	}
+}
+
+func TestCollector_SchemaChange(t *testing.T) {
+	r := &fakeQueryRunner{[]Metric{
+		NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1.1}),
+	}}
+	c := NewCollector(r, prometheus.GaugeValue, "fake_metric", "", nil)
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	// Without a declared schema, results with a new value are accepted and
+	// reported with the existing descs.
+	r.metrics = []Metric{NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 2.2, "_new": 3.3})}
+	if err := c.Update(); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	mfs, err := reg.Gather()
+	if err != nil || len(mfs) != 1 || mfs[0].Metric[0].GetGauge().GetValue() != 2.2 {
+		t.Errorf("Gather() = %v, %v; want fake_metric 2.2", mfs, err)
+	}
+	// Results with new labels are accepted too, but cannot be reported.
+	r.metrics = []Metric{NewMetric([]string{"key", "other"}, []string{"thing", "x"}, map[string]float64{"": 1.1})}
+	if err := c.Update(); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if _, err := reg.Gather(); err == nil {
+		t.Errorf("Gather() expected error for inconsistent labels")
+	}
+}
+
+func TestSchema_Equal(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *Schema
+		want bool
+	}{
+		{name: "nil", want: true},
+		{name: "one-nil", a: &Schema{}, want: false},
+		{name: "nil-and-empty-keys", a: &Schema{LabelKeys: []string{}}, b: &Schema{}, want: true},
+		{name: "different-values", a: &Schema{ValueKeys: []string{""}}, b: &Schema{ValueKeys: []string{"_x"}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Equal(tt.b); got != tt.want {
+				t.Errorf("Schema.Equal() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+type statsQueryRunner struct {
+	fakeQueryRunner
+}
+
+func (qr *statsQueryRunner) LastStats() Stats {
+	return Stats{BytesBilled: 1024}
+}
+
+func TestCollector_Stats(t *testing.T) {
+	qr := &statsQueryRunner{}
+	qr.metrics = []Metric{NewMetric([]string{"key"}, []string{"thing"}, map[string]float64{"": 1.1})}
+	c := NewCollector(qr, prometheus.GaugeValue, "fake_metric", "SELECT 1", nil)
+	if err := c.Update(); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if r := c.Results(); r == nil || r.Stats.BytesBilled != 1024 {
+		t.Errorf("Results() = %#v, want 1024 bytes billed", r)
+	}
+	if c.Query() != "SELECT 1" {
+		t.Errorf("Query() = %q, want %q", c.Query(), "SELECT 1")
+	}
+}
+
+func TestCollector_Timestamps(t *testing.T) {
+	day1 := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	newMetric := func(site string, v float64, ts time.Time) Metric {
+		m := NewMetric([]string{"site"}, []string{site}, map[string]float64{"": v})
+		m.Timestamp = ts
+		return m
+	}
+	qr := &fakeQueryRunner{metrics: []Metric{
+		newMetric("lga01", 2, day2),
+		newMetric("lga01", 1, day1),
+		newMetric("nuq01", 3, day1),
+	}}
+	c := NewCollector(qr, prometheus.GaugeValue, "fake_metric", "", nil)
+	if err := c.Update(); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	// Results include every metric, while Collect only reports the latest
+	// metric of every series.
+	if r := c.Results(); len(r.Metrics) != 3 {
+		t.Errorf("Results() = %d metrics, want 3", len(r.Metrics))
+	}
+	ch := make(chan prometheus.Metric, 3)
+	c.Collect(ch)
+	close(ch)
+	got := map[string]float64{}
+	for m := range ch {
+		pb := &dto.Metric{}
+		m.Write(pb)
+		got[pb.GetLabel()[0].GetValue()] = pb.GetGauge().GetValue()
+	}
+	want := map[string]float64{"lga01": 2, "nuq01": 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_Counter(t *testing.T) {
+	created := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	m1 := NewMetric([]string{"site"}, []string{"lga01"}, map[string]float64{"": 10})
+	m1.Created = created
+	m1.Exemplar = map[string]string{"trace_id": "abc123"}
+	m2 := NewMetric([]string{"site"}, []string{"nuq01"}, map[string]float64{"": 20})
+	// Exemplar labels longer than 128 characters are invalid and not reported.
+	m2.Exemplar = map[string]string{"trace_id": strings.Repeat("x", 200)}
+	qr := &fakeQueryRunner{metrics: []Metric{m1, m2}}
+	c := NewCollector(qr, prometheus.CounterValue, "fake_metric", "", nil)
+	c.SetUnit("bytes")
+	if len(c.Units()) != 0 {
+		t.Errorf("Units() = %v, want none before Update", c.Units())
+	}
+	if err := c.Update(); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if want := map[string]string{"fake_metric_bytes_total": "bytes"}; !reflect.DeepEqual(c.Units(), want) {
+		t.Errorf("Units() = %v, want %v", c.Units(), want)
+	}
+	if want := map[string]string{"": "fake_metric_bytes_total"}; !reflect.DeepEqual(c.Results().Names, want) {
+		t.Errorf("Results().Names = %v, want %v", c.Results().Names, want)
+	}
+	ch := make(chan prometheus.Metric, 2)
+	c.Collect(ch)
+	close(ch)
+	got := map[string]*dto.Counter{}
+	for m := range ch {
+		if !strings.Contains(m.Desc().String(), `"fake_metric_bytes_total"`) {
+			t.Errorf("Collect() desc = %v, want fake_metric_bytes_total", m.Desc())
+		}
+		pb := &dto.Metric{}
+		m.Write(pb)
+		got[pb.GetLabel()[0].GetValue()] = pb.GetCounter()
+	}
+	lga := got["lga01"]
+	if lga.GetValue() != 10 || !lga.GetCreatedTimestamp().AsTime().Equal(created) {
+		t.Errorf("Collect() lga01 = %v, want value 10 created at %v", lga, created)
+	}
+	if e := lga.GetExemplar(); e.GetValue() != 10 || e.GetLabel()[0].GetValue() != "abc123" {
+		t.Errorf("Collect() lga01 exemplar = %v, want trace_id abc123", e)
+	}
+	nuq := got["nuq01"]
+	if nuq.GetValue() != 20 || nuq.CreatedTimestamp != nil || nuq.Exemplar != nil {
+		t.Errorf("Collect() nuq01 = %v, want value 20 without created or exemplar", nuq)
+	}
+}
@@ -0,0 +1,52 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	invalidRE    = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// ValidMetricName reports whether name satisfies the Prometheus metric naming rules.
+func ValidMetricName(name string) bool {
+	return metricNameRE.MatchString(name)
+}
+
+// ValidLabelName reports whether name satisfies the Prometheus label naming
+// rules. Names starting with "__" are reserved for internal use.
+func ValidLabelName(name string) bool {
+	return labelNameRE.MatchString(name) && !strings.HasPrefix(name, "__")
+}
+
+// SanitizeName converts name into a valid Prometheus metric or label name by
+// replacing every illegal character with an underscore. Names starting with a
+// digit are prefixed with an underscore. Because colons are reserved for
+// recording rules, they are replaced as well.
+func SanitizeName(name string) string {
+	s := invalidRE.ReplaceAllString(name, "_")
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "_" + s
+	}
+	return s
+}
+
+// sanitizeNames sanitizes every name and reports an error if two different
+// names are identical after sanitization.
+func sanitizeNames(kind string, names []string) ([]string, error) {
+	result := make([]string, len(names))
+	seen := make(map[string]string, len(names))
+	for i, name := range names {
+		s := SanitizeName(name)
+		if prev, ok := seen[s]; ok {
+			return nil, fmt.Errorf("%s names %q and %q both normalize to %q", kind, prev, name, s)
+		}
+		seen[s] = name
+		result[i] = s
+	}
+	return result, nil
+}
@@ -0,0 +1,69 @@
+package sql
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "bq_ndt_test", want: "bq_ndt_test"},
+		{name: "ndt-tests.v2", want: "ndt_tests_v2"},
+		{name: "value-p50", want: "value_p50"},
+		{name: "a:b", want: "a_b"},
+		{name: "5xx", want: "_5xx"},
+		{name: "", want: "_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeName(tt.name); got != tt.want {
+				t.Errorf("SanitizeName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+			if !ValidMetricName(SanitizeName(tt.name)) {
+				t.Errorf("ValidMetricName(SanitizeName(%q)) = false, want true", tt.name)
+			}
+		})
+	}
+}
+
+func TestValidNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		validMetric bool
+		validLabel  bool
+	}{
+		{name: "machine", validMetric: true, validLabel: true},
+		{name: "job:rate5m", validMetric: true},
+		{name: "__name__", validMetric: true},
+		{name: "value-p50"},
+		{name: "1abc"},
+		{name: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidMetricName(tt.name); got != tt.validMetric {
+				t.Errorf("ValidMetricName(%q) = %t, want %t", tt.name, got, tt.validMetric)
+			}
+			if got := ValidLabelName(tt.name); got != tt.validLabel {
+				t.Errorf("ValidLabelName(%q) = %t, want %t", tt.name, got, tt.validLabel)
+			}
+		})
+	}
+}
+
+func TestSanitizeNames(t *testing.T) {
+	got, err := sanitizeNames("label", []string{"a-b", "c"})
+	if err != nil {
+		t.Fatalf("sanitizeNames() error = %v", err)
+	}
+	if want := []string{"a_b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sanitizeNames() = %v, want %v", got, want)
+	}
+	_, err = sanitizeNames("label", []string{"a-b", "a_b"})
+	if err == nil {
+		t.Errorf("sanitizeNames() expected collision error")
+	}
+}
@@ -0,0 +1,83 @@
+package sql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Staleness reports the "bqx_query_stale" metric for every collector with a
+// maximum staleness, with a "query" label equal to the metric name of the
+// collector. The metric is 1 when the cached metrics of the collector are
+// expired or missing and 0 otherwise. Like the other exporter metrics, the
+// name is fixed and has no namespace. Staleness must be registered once, with
+// the same registry as the collectors.
+var Staleness = newStaleCollector()
+
+// staleCollector reports the staleness of collectors from one GaugeVec, so
+// that queries with different constant labels share the same description.
+type staleCollector struct {
+	vec *prometheus.GaugeVec
+	// mux locks access to cols.
+	mux sync.Mutex
+	// cols holds the collectors with a maximum staleness, by metric name.
+	cols map[string]*Collector
+}
+
+// NewStaleness returns a collector that reports the "bqx_query_stale" metric
+// for the given collectors, like Staleness. Collectors without a maximum
+// staleness are ignored.
+func NewStaleness(cols ...*Collector) prometheus.Collector {
+	s := newStaleCollector()
+	for _, col := range cols {
+		s.set(col)
+	}
+	return s
+}
+
+func newStaleCollector() *staleCollector {
+	return &staleCollector{
+		vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "bqx_query_stale",
+			Help: "Whether cached query results are older than the maximum staleness.",
+		}, []string{"query"}),
+		cols: map[string]*Collector{},
+	}
+}
+
+// set reports the staleness of col, replacing any previous collector with the
+// same metric name. If col has no maximum staleness, it is no longer reported.
+func (s *staleCollector) set(col *Collector) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if col.maxStaleness > 0 {
+		s.cols[col.metricName] = col
+		return
+	}
+	if s.cols[col.metricName] == col {
+		delete(s.cols, col.metricName)
+		s.vec.DeleteLabelValues(col.metricName)
+	}
+}
+
+// Describe satisfies the prometheus.Collector interface.
+func (s *staleCollector) Describe(ch chan<- *prometheus.Desc) {
+	s.vec.Describe(ch)
+}
+
+// Collect satisfies the prometheus.Collector interface. Collect reports the
+// staleness of every collector at the time of collection.
+func (s *staleCollector) Collect(ch chan<- prometheus.Metric) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	now := time.Now()
+	for name, col := range s.cols {
+		val := 0.0
+		if col.stale(now) {
+			val = 1.0
+		}
+		s.vec.WithLabelValues(name).Set(val)
+	}
+	s.vec.Collect(ch)
+}
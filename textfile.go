@@ -0,0 +1,17 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// textfileName is the name of the file written to the -textfile-dir. The
+// node_exporter textfile collector reads files ending in ".prom".
+const textfileName = "bigquery_exporter.prom"
+
+// writeTextfile writes the metrics from g to the textfile in dir. The file is
+// replaced atomically, so readers never observe a partially written file.
+func writeTextfile(dir string, g prometheus.Gatherer) error {
+	return prometheus.WriteToTextfile(filepath.Join(dir, textfileName), g)
+}
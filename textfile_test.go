@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_writeTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "textfile")
+	rtx.Must(err, "Failed to create temp dir")
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "textfile_metric", Help: "help text"})
+	g.Set(1.5)
+	reg.MustRegister(g)
+
+	if err := writeTextfile(dir, reg); err != nil {
+		t.Fatalf("writeTextfile() error = %v", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, textfileName))
+	rtx.Must(err, "Failed to read textfile")
+	want := "# HELP textfile_metric help text\n# TYPE textfile_metric gauge\ntextfile_metric 1.5\n"
+	if string(b) != want {
+		t.Errorf("writeTextfile() wrote %q, want %q", b, want)
+	}
+	// Only the textfile remains in the directory.
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	rtx.Must(err, "Failed to list dir")
+	if len(names) != 1 {
+		t.Errorf("writeTextfile() left files %v, want only %s", names, textfileName)
+	}
+
+	if err := writeTextfile(filepath.Join(dir, "missing"), reg); err == nil {
+		t.Errorf("writeTextfile() expected error for missing directory")
+	}
+}
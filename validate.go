@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+	"github.com/m-lab/prometheus-bigquery-exporter/query"
+	"github.com/m-lab/prometheus-bigquery-exporter/sql"
+)
+
+// reservedRE matches every word that contains a template variable name.
+var reservedRE = regexp.MustCompile(`\w*(UNIX_START_TIME|REFRESH_RATE_SEC)\w*`)
+
+// columnsFunc returns the names of the result columns of a query, and whether
+// every result column was found.
+type columnsFunc func(query string) (names []string, complete bool, err error)
+
+// parseColumns returns the result columns of a query parsed locally.
+func parseColumns(q string) ([]string, bool, error) {
+	names, complete := query.ParseColumns(q)
+	return names, complete, nil
+}
+
+// validateQueries checks every file for problems that would prevent the
+// exporter from reporting its metrics, and returns a description of every
+// problem found. The result columns of every query are found with columns.
+func validateQueries(files []setup.File, namespace string, vars map[string]string, columns columnsFunc) []string {
+	problems := []string{}
+	if err := validateFiles(files, namespace); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for i := range files {
+		cols := columns
+		if files[i].Config.Driver != "" {
+			// Queries for other databases cannot be checked by BigQuery.
+			cols = parseColumns
+		}
+		for _, p := range validateQuery(files[i].Name, vars, cols) {
+			problems = append(problems, files[i].Name+": "+p)
+		}
+	}
+	return problems
+}
+
+// validateQuery checks the named query file, and returns a description of
+// every problem found.
+func validateQuery(name string, vars map[string]string, columns columnsFunc) []string {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	problems := []string{}
+	for _, m := range reservedRE.FindAllStringSubmatch(string(b), -1) {
+		if m[0] != m[1] {
+			problems = append(problems, fmt.Sprintf("%q contains the template variable %s, which will be replaced", m[0], m[1]))
+		}
+	}
+	names, complete, err := columns(fileToQuery(name, vars))
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	values := 0
+	for _, c := range names {
+		if strings.HasPrefix(c, "value") {
+			values++
+		} else if !sql.ValidLabelName(sql.SanitizeName(c)) {
+			problems = append(problems, fmt.Sprintf("invalid label column %q", c))
+		}
+	}
+	// Columns that were not found may be value columns.
+	if values == 0 && complete {
+		problems = append(problems, fmt.Sprintf("no value column found in %v", names))
+	}
+	return problems
+}
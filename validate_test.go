@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/prometheus-bigquery-exporter/internal/setup"
+	"github.com/m-lab/prometheus-bigquery-exporter/query"
+)
+
+func Test_validateQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validate")
+	rtx.Must(err, "Failed to create temp dir")
+	defer os.RemoveAll(dir)
+	queries := map[string]string{
+		"ok.sql":       "SELECT site, COUNT(*) AS value FROM t WHERE ts > UNIX_START_TIME GROUP BY site",
+		"reserved.sql": "SELECT 1 AS value, MY_UNIX_START_TIME_X AS site FROM t",
+		"novalue.sql":  "SELECT site, COUNT(*) AS total FROM t GROUP BY site",
+		"label.sql":    "SELECT __site, 1 AS value FROM t",
+		"implicit.sql": "SELECT label, SUM(x) value FROM t GROUP BY label",
+		"star.sql":     "SELECT * FROM t",
+		"error.sql":    "SELECT dry run error",
+		"bad-1.sql":    "SELECT 1 AS value",
+		"bad_1.sql":    "SELECT 1 AS value",
+	}
+	for name, q := range queries {
+		rtx.Must(ioutil.WriteFile(dir+"/"+name, []byte(q), 0644), "Failed to write file")
+	}
+	columns := func(q string) ([]string, bool, error) {
+		if q == queries["error.sql"] {
+			return nil, false, fmt.Errorf("fake dry run error")
+		}
+		names, complete := query.ParseColumns(q)
+		return names, complete, nil
+	}
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{
+			name:  "ok",
+			files: []string{"ok.sql"},
+			want:  []string{},
+		},
+		{
+			name:  "reserved",
+			files: []string{"reserved.sql"},
+			want:  []string{dir + `/reserved.sql: "MY_UNIX_START_TIME_X" contains the template variable UNIX_START_TIME, which will be replaced`},
+		},
+		{
+			name:  "no-value",
+			files: []string{"novalue.sql"},
+			want:  []string{dir + "/novalue.sql: no value column found in [site total]"},
+		},
+		{
+			name:  "implicit-alias",
+			files: []string{"implicit.sql"},
+			want:  []string{},
+		},
+		{
+			name:  "star",
+			files: []string{"star.sql"},
+			want:  []string{},
+		},
+		{
+			name:  "invalid-label",
+			files: []string{"label.sql"},
+			want:  []string{dir + `/label.sql: invalid label column "__site"`},
+		},
+		{
+			name:  "dry-run-error",
+			files: []string{"error.sql"},
+			want:  []string{dir + "/error.sql: fake dry run error"},
+		},
+		{
+			name:  "missing-file",
+			files: []string{"missing.sql"},
+			want:  []string{dir + "/missing.sql: open " + dir + "/missing.sql: no such file or directory"},
+		},
+		{
+			name:  "duplicate-metric",
+			files: []string{"bad-1.sql", "bad_1.sql"},
+			want:  []string{dir + "/bad-1.sql and " + dir + `/bad_1.sql both report metric "bad_1"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := make([]setup.File, len(tt.files))
+			for i := range tt.files {
+				files[i].Name = dir + "/" + tt.files[i]
+			}
+			got := validateQueries(files, "", map[string]string{"UNIX_START_TIME": "0"}, columns)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateQueries() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}